@@ -0,0 +1,21 @@
+//go:build patchworkmcp_cbor
+
+// PatchworkMCP — optional CBOR encoding for the Go drop-in.
+//
+// Copy this file next to feedback_tool.go and build with
+// -tags patchworkmcp_cbor. It is the only part of the drop-in that needs a
+// dependency beyond mcp-go:
+//
+//   go get github.com/fxamacker/cbor/v2
+//
+// Then set Options.Encoding to CBOR.
+
+package feedback
+
+import "github.com/fxamacker/cbor/v2"
+
+// CBOR encodes feedback requests as RFC 8949 CBOR.
+var CBOR = &Encoding{
+	ContentType: "application/cbor",
+	Marshal:     cbor.Marshal,
+}
@@ -0,0 +1,76 @@
+//go:build patchworkmcp_gosdk
+
+// PatchworkMCP — adapter for the official Go SDK
+// (github.com/modelcontextprotocol/go-sdk).
+//
+// Copy this file next to feedback_tool.go and build with
+// -tags patchworkmcp_gosdk:
+//
+//   go get github.com/modelcontextprotocol/go-sdk
+//
+// Delivery, retries, spooling, and every Options field are shared with the
+// mcp-go registration; only the tool and handler types differ. The core file
+// still imports mcp-go for its own types.
+
+package feedback
+
+import (
+	"context"
+	"encoding/json"
+
+	sdkmcp "github.com/modelcontextprotocol/go-sdk/mcp"
+)
+
+// NewSDKFeedbackTool returns the feedback tool definition for the official
+// SDK, with the same name, description, schema, and annotations as
+// NewFeedbackToolWithOptions. Pass nil for opts to use the defaults.
+func NewSDKFeedbackTool(opts *Options) *sdkmcp.Tool {
+	t := NewFeedbackToolWithOptions(opts)
+	a := t.Annotations
+	return &sdkmcp.Tool{
+		Name:        t.Name,
+		Description: t.Description,
+		InputSchema: ToolInputSchema(),
+		Annotations: &sdkmcp.ToolAnnotations{
+			Title:           a.Title,
+			ReadOnlyHint:    a.ReadOnlyHint != nil && *a.ReadOnlyHint,
+			DestructiveHint: a.DestructiveHint,
+			IdempotentHint:  a.IdempotentHint != nil && *a.IdempotentHint,
+			OpenWorldHint:   a.OpenWorldHint,
+		},
+	}
+}
+
+// NewSDKFeedbackHandler returns an official-SDK tool handler bound to a
+// server name. Pass nil for opts to use environment variable defaults.
+func NewSDKFeedbackHandler(serverName string, opts *Options) sdkmcp.ToolHandler {
+	return func(ctx context.Context, req *sdkmcp.CallToolRequest) (*sdkmcp.CallToolResult, error) {
+		if _, ok := ctx.Value(requestIDContextKey{}).(string); !ok {
+			ctx = WithRequestID(ctx, newID())
+		}
+		var args map[string]any
+		if len(req.Params.Arguments) > 0 {
+			if err := json.Unmarshal(req.Params.Arguments, &args); err != nil {
+				return &sdkmcp.CallToolResult{
+					Content: []sdkmcp.Content{&sdkmcp.TextContent{Text: "Feedback arguments must be a JSON object."}},
+					IsError: true,
+				}, nil
+			}
+		}
+		res := safeSubmit(ctx, args, serverName, opts)
+		return &sdkmcp.CallToolResult{
+			Content: []sdkmcp.Content{&sdkmcp.TextContent{Text: res.Message}},
+			IsError: res.Rejected,
+		}, nil
+	}
+}
+
+// RegisterFeedbackToolSDK is RegisterFeedbackTool for the official SDK.
+// Options.ExposeStatusResource is not supported here.
+//
+//	s := mcp.NewServer(&mcp.Implementation{Name: "my-server"}, nil)
+//	feedback.RegisterFeedbackToolSDK(s, "my-server", nil)
+func RegisterFeedbackToolSDK(s *sdkmcp.Server, serverName string, opts *Options) {
+	s.AddTool(NewSDKFeedbackTool(opts), NewSDKFeedbackHandler(serverName, opts))
+	startRegistered(serverName, opts)
+}
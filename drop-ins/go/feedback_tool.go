@@ -3,26 +3,58 @@
 // Copy this file into your project. Works with:
 //   - github.com/mark3labs/mcp-go  → RegisterFeedbackTool(server, "my-server")
 //   - Manual registration          → NewFeedbackTool(), NewFeedbackHandler()
+//   - Plain net/http services      → FeedbackHTTPHandler()
+//   - Official Go SDK              → RegisterFeedbackToolSDK() in feedback_gosdk.go
 //
 // No extra dependencies beyond mcp-go and the standard library.
 //
 // Configuration via environment:
 //   FEEDBACK_SIDECAR_URL  - default: http://localhost:8099
 //   FEEDBACK_API_KEY      - optional shared secret
+//   FEEDBACK_API_KEY_FILE - file containing the secret (FEEDBACK_API_KEY wins)
+//   FEEDBACK_SPOOL_PATH   - optional file for undeliverable feedback
+//   BUILD_SHA / GIT_SHA   - optional build identifier sent as build_id
+//   FEEDBACK_ENV          - environment name looked up in Options.EnvRouting
 
 package feedback
 
 import (
+	"bufio"
 	"bytes"
+	"container/list"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
+	"maps"
 	"math"
+	mrand "math/rand/v2"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	"github.com/mark3labs/mcp-go/mcp"
 	"github.com/mark3labs/mcp-go/server"
@@ -31,6 +63,9 @@ import (
 var (
 	sidecarURL = getEnv("FEEDBACK_SIDECAR_URL", "http://localhost:8099")
 	apiKey     = os.Getenv("FEEDBACK_API_KEY")
+	apiKeyFile = os.Getenv("FEEDBACK_API_KEY_FILE")
+	spoolPath  = os.Getenv("FEEDBACK_SPOOL_PATH")
+	envName    = os.Getenv("FEEDBACK_ENV")
 )
 
 // ── HTTP Client Config ─────────────────────────────────────────────────────
@@ -39,6 +74,8 @@ const (
 	maxRetries     = 2
 	initialBackoff = 500 * time.Millisecond // doubles each retry
 	userAgent      = "PatchworkMCP-Go/1.0"
+	defaultAccept  = "application/json" // ask for the structured acknowledgement
+	defaultSchema  = "v1"               // payload shape sent as X-Feedback-Schema
 )
 
 // Module-level client with connection pooling and sensible timeouts.
@@ -54,9 +91,84 @@ var httpClient = &http.Client{
 	},
 }
 
+// Shares httpClient's connection pool but leaves the deadline to the request
+// context, so AdaptiveTimeout can exceed the fixed 5s timeout when needed.
+var adaptiveClient = &http.Client{Transport: httpClient.Transport}
+
+// clientKey identifies a client derived from Options.Timeout and
+// Options.TLSConfig. A zero timeout means the request context sets the
+// deadline, as with adaptiveClient.
+type clientKey struct {
+	timeout time.Duration
+	tls     *tls.Config
+}
+
+var (
+	clientMu sync.Mutex
+	clients  = map[clientKey]*http.Client{}
+)
+
+// clientFor returns the shared client for timeout and tlsConf, building it
+// on first use. Clients for the same settings share one transport and its
+// connection pool, so custom settings cost nothing per call.
+func clientFor(timeout time.Duration, tlsConf *tls.Config) *http.Client {
+	if tlsConf == nil {
+		switch timeout {
+		case httpClient.Timeout:
+			return httpClient
+		case 0:
+			return adaptiveClient
+		}
+	}
+	clientMu.Lock()
+	defer clientMu.Unlock()
+	key := clientKey{timeout, tlsConf}
+	if c, ok := clients[key]; ok {
+		return c
+	}
+	transport := httpClient.Transport
+	if tlsConf != nil {
+		// Every client for this TLS config shares one transport, whatever
+		// its timeout.
+		if c, ok := clients[clientKey{0, tlsConf}]; ok {
+			transport = c.Transport
+		} else {
+			t := httpClient.Transport.(*http.Transport).Clone()
+			t.TLSClientConfig = tlsConf
+			transport = t
+			clients[clientKey{0, tlsConf}] = &http.Client{Transport: t}
+		}
+	}
+	c := &http.Client{Timeout: timeout, Transport: transport}
+	clients[key] = c
+	return c
+}
+
 // Prefix makes these log lines greppable in any log aggregator.
 const logPrefix = "PATCHWORKMCP_UNSENT_FEEDBACK"
 
+// warnPrefix marks configuration problems the operator should fix.
+const warnPrefix = "PATCHWORKMCP_WARNING"
+
+func logWarning(format string, args ...any) {
+	fmt.Fprintf(os.Stderr, "%s %s\n", warnPrefix, fmt.Sprintf(format, args...))
+}
+
+// Logger is the subset of *slog.Logger the drop-in logs through, so hosts
+// can pass their own slog logger or an adapter for another library.
+type Logger interface {
+	Debug(msg string, args ...any)
+}
+
+var defaultLogger Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelDebug}))
+
+func (o *Options) logger() Logger {
+	if o != nil && o.Logger != nil {
+		return o.Logger
+	}
+	return defaultLogger
+}
+
 func isRetryableStatus(code int) bool {
 	return code == 429 || code == 500 || code == 502 || code == 503 || code == 504
 }
@@ -65,8 +177,248 @@ func isRetryableStatus(code int) bool {
 // hosting environment captures it. The structured JSON is greppable via
 // logPrefix and can be replayed from whatever log aggregation the containing
 // server uses (Heroku logs, CloudWatch, Docker stdout, etc.).
-func logUnsentPayload(body []byte, reason string) {
-	fmt.Fprintf(os.Stderr, "%s reason=%s payload=%s\n", logPrefix, reason, string(body))
+//
+// Options.OnUnsent, if set, receives the same record; Options.SilenceUnsentLog
+// suppresses the stderr write. With Options.SignUnsentLog, the record carries
+// an HMAC (not in the legacy format).
+func logUnsentPayload(body []byte, reason string, opts *Options) {
+	line := UnsentLine{Time: opts.clock().Now().UTC(), Reason: reason, Payload: body}
+	if opts != nil && opts.SignUnsentLog != nil {
+		// Sign the payload as FormatUnsentLine writes it, so the logged
+		// line verifies even for a non-JSON (fallback-encoded) body.
+		line.Payload = unsentPayload(body)
+		line.KeyID = opts.SignUnsentLog.ID
+		line.HMAC = hex.EncodeToString(line.mac(opts.SignUnsentLog.Secret))
+	}
+	if opts != nil && opts.OnUnsent != nil {
+		opts.OnUnsent(line)
+	}
+	switch {
+	case opts != nil && opts.SilenceUnsentLog:
+	case opts != nil && opts.UnsentLogPerMinute > 0 && !unsentLimiter.allow(opts.UnsentLogPerMinute, opts.clock().Now()):
+	case opts != nil && opts.LegacyUnsentLog:
+		fmt.Fprintf(os.Stderr, "%s reason=%s payload=%s\n", logPrefix, reason, string(body))
+	case opts != nil && opts.ChunkUnsentLog > 0:
+		for _, l := range chunkUnsentLine(FormatUnsentLine(line), opts.ChunkUnsentLog) {
+			fmt.Fprintln(os.Stderr, l)
+		}
+	default:
+		fmt.Fprintln(os.Stderr, FormatUnsentLine(line))
+	}
+}
+
+// unsentRateLimiter caps unsent-log lines per minute across the process.
+// Lines over the cap are only counted, and the count is logged when the
+// minute ends.
+type unsentRateLimiter struct {
+	mu         sync.Mutex
+	window     time.Time // start of the current minute
+	logged     int
+	suppressed int
+}
+
+var unsentLimiter unsentRateLimiter
+
+const unsentLogWindow = time.Minute
+
+// allow reports whether another line may be logged now. The first line
+// suppressed in a window schedules that window's summary.
+func (l *unsentRateLimiter) allow(perMinute int, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if now.Sub(l.window) >= unsentLogWindow {
+		l.window, l.logged = now, 0
+	}
+	if l.logged < perMinute {
+		l.logged++
+		return true
+	}
+	if l.suppressed == 0 {
+		time.AfterFunc(l.window.Add(unsentLogWindow).Sub(now), l.summarize)
+	}
+	l.suppressed++
+	return false
+}
+
+// summarize logs and resets the suppressed count.
+func (l *unsentRateLimiter) summarize() {
+	l.mu.Lock()
+	n := l.suppressed
+	l.suppressed = 0
+	l.mu.Unlock()
+	if n > 0 {
+		logWarning("unsent log rate limit: suppressed %d unsent-feedback lines in the last minute", n)
+	}
+}
+
+// chunkPrefix marks one piece of an unsent-feedback line that was too long
+// to log whole. It deliberately doesn't start with logPrefix.
+const chunkPrefix = "PATCHWORKMCP_UNSENT_CHUNK"
+
+// unsentChunk is one piece of a chunked line. Data pieces, concatenated in
+// Seq order (1-based), are the base64 of the JSON after logPrefix.
+type unsentChunk struct {
+	ID    string `json:"id"`
+	Seq   int    `json:"seq"`
+	Total int    `json:"total"`
+	Data  string `json:"data"`
+}
+
+// chunkUnsentLine returns line unchanged if it fits in limit bytes, or
+// splits it into chunkPrefix lines that each do.
+func chunkUnsentLine(line string, limit int) []string {
+	if len(line) <= limit {
+		return []string{line}
+	}
+	data := base64.StdEncoding.EncodeToString([]byte(strings.TrimPrefix(line, logPrefix+" ")))
+	size := max(limit-128, 64) // room for the prefix and chunk fields
+	id := newID()
+	total := (len(data) + size - 1) / size
+	lines := make([]string, 0, total)
+	for seq := 1; len(data) > 0; seq++ {
+		n := min(size, len(data))
+		b, _ := json.Marshal(unsentChunk{ID: id, Seq: seq, Total: total, Data: data[:n]})
+		lines = append(lines, chunkPrefix+" "+string(b))
+		data = data[n:]
+	}
+	return lines
+}
+
+// UnsentReassembler parses a stream of log lines, reassembling chunked
+// unsent-feedback lines (Options.ChunkUnsentLog). Chunks of different lines
+// may interleave. The zero value is ready to use.
+type UnsentReassembler struct {
+	pending map[string][]string
+}
+
+// Add feeds one log line. It returns the parsed line and true when line is a
+// whole unsent-feedback line or completes a chunked one; lines that are
+// neither, and incomplete chunk sets, return false.
+func (r *UnsentReassembler) Add(line string) (UnsentLine, bool, error) {
+	i := strings.Index(line, chunkPrefix)
+	if i < 0 {
+		if !strings.Contains(line, logPrefix) {
+			return UnsentLine{}, false, nil
+		}
+		l, err := ParseUnsentLine(line)
+		return l, err == nil, err
+	}
+	var c unsentChunk
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line[i+len(chunkPrefix):])), &c); err != nil {
+		return UnsentLine{}, false, err
+	}
+	if c.Total <= 0 || c.Seq < 1 || c.Seq > c.Total {
+		return UnsentLine{}, false, fmt.Errorf("chunk %d of %d out of range", c.Seq, c.Total)
+	}
+	if r.pending == nil {
+		r.pending = map[string][]string{}
+	}
+	parts := r.pending[c.ID]
+	if parts == nil {
+		parts = make([]string, c.Total)
+		r.pending[c.ID] = parts
+	}
+	if len(parts) != c.Total {
+		return UnsentLine{}, false, fmt.Errorf("chunk %s: total changed from %d to %d", c.ID, len(parts), c.Total)
+	}
+	parts[c.Seq-1] = c.Data
+	if slices.Contains(parts, "") {
+		return UnsentLine{}, false, nil
+	}
+	delete(r.pending, c.ID)
+	raw, err := base64.StdEncoding.DecodeString(strings.Join(parts, ""))
+	if err != nil {
+		return UnsentLine{}, false, err
+	}
+	l, err := ParseUnsentLine(logPrefix + " " + string(raw))
+	return l, err == nil, err
+}
+
+// UnsentLine is one unsent-feedback log line. Log shippers (Vector, Fluent
+// Bit, etc.) can match logPrefix, parse the rest with ParseUnsentLine, and
+// route Payload into a retry queue.
+type UnsentLine struct {
+	Time    time.Time       `json:"time,omitzero"`
+	Reason  string          `json:"reason"`
+	Payload json.RawMessage `json:"payload"`
+	// KeyID and HMAC are set when Options.SignUnsentLog is configured.
+	KeyID string `json:"key_id,omitempty"`
+	HMAC  string `json:"hmac,omitempty"`
+}
+
+// SigningKey is a secret for HMAC-SHA256 signatures. Only ID is ever logged,
+// so reviewers can tell which key to verify with after a rotation.
+type SigningKey struct {
+	ID     string
+	Secret []byte
+}
+
+// mac is HMAC-SHA256 over the line's time, reason, and payload.
+func (l UnsentLine) mac(secret []byte) []byte {
+	m := hmac.New(sha256.New, secret)
+	fmt.Fprintf(m, "%s\n%s\n", l.Time.UTC().Format(time.RFC3339Nano), l.Reason)
+	m.Write(l.Payload)
+	return m.Sum(nil)
+}
+
+// VerifyUnsentLine reports whether l, typically from ParseUnsentLine, is
+// signed with key and unaltered since it was logged.
+func VerifyUnsentLine(l UnsentLine, key SigningKey) bool {
+	sig, err := hex.DecodeString(l.HMAC)
+	if err != nil || l.KeyID != key.ID {
+		return false
+	}
+	return hmac.Equal(sig, l.mac(key.Secret))
+}
+
+// FormatUnsentLine renders l as logPrefix followed by a single-line JSON
+// object, so standard JSON log parsers can handle everything after the prefix.
+func FormatUnsentLine(l UnsentLine) string {
+	l.Payload = unsentPayload(l.Payload)
+	// Unescaped, so the payload in the line matches the signed bytes.
+	b, _ := marshalJSON(l)
+	return logPrefix + " " + string(b)
+}
+
+// unsentPayload returns body as it appears in a formatted line: compacted
+// JSON, or a JSON string if body is not JSON, which keeps the line
+// parseable.
+func unsentPayload(body []byte) json.RawMessage {
+	var buf bytes.Buffer
+	if json.Compact(&buf, body) != nil {
+		b, _ := marshalJSON(string(body))
+		return b
+	}
+	return buf.Bytes()
+}
+
+// ParseUnsentLine parses a line written by FormatUnsentLine, or by the legacy
+// "reason=… payload=…" format (Options.LegacyUnsentLog). Leading text before
+// logPrefix, such as a timestamp added by the log pipeline, is ignored.
+func ParseUnsentLine(line string) (UnsentLine, error) {
+	i := strings.Index(line, logPrefix)
+	if i < 0 {
+		return UnsentLine{}, errors.New("not an unsent-feedback line")
+	}
+	rest := strings.TrimSpace(line[i+len(logPrefix):])
+
+	var l UnsentLine
+	if strings.HasPrefix(rest, "{") {
+		if err := json.Unmarshal([]byte(rest), &l); err != nil {
+			return UnsentLine{}, err
+		}
+		return l, nil
+	}
+
+	rest, ok := strings.CutPrefix(rest, "reason=")
+	if !ok {
+		return UnsentLine{}, errors.New("unrecognized unsent-feedback line")
+	}
+	reason, payload, ok := strings.Cut(rest, " payload=")
+	if !ok || !json.Valid([]byte(payload)) {
+		return UnsentLine{}, errors.New("malformed legacy unsent-feedback line")
+	}
+	return UnsentLine{Reason: reason, Payload: json.RawMessage(payload)}, nil
 }
 
 func getEnv(key, fallback string) string {
@@ -90,10 +442,41 @@ const ToolDescription = "Report when you cannot find what you need or when avail
 	"If you could not fully satisfy the user's request with the available " +
 	"tools, call this BEFORE giving your final response."
 
+// ToolDescriptionShort is a compact ToolDescription for hosts that put every
+// tool description in the prompt. Select it with Options.UseShortDescription.
+const ToolDescriptionShort = "Report when the available tools fall short of the task: missing, " +
+	"incomplete, or needing a workaround. Call this before your final response."
+
+// defaultAnnotations mark the tool as safe to call without confirmation: it
+// only submits a report and never modifies the host's environment.
+func defaultAnnotations() mcp.ToolAnnotation {
+	return mcp.ToolAnnotation{
+		ReadOnlyHint:    mcp.ToBoolPtr(true),
+		DestructiveHint: mcp.ToBoolPtr(false),
+		IdempotentHint:  mcp.ToBoolPtr(true),
+		OpenWorldHint:   mcp.ToBoolPtr(true),
+	}
+}
+
 // NewFeedbackTool returns the MCP tool definition for registration.
 func NewFeedbackTool() mcp.Tool {
+	return NewFeedbackToolWithOptions(nil)
+}
+
+// NewFeedbackToolWithOptions is NewFeedbackTool with the description and
+// annotations taken from opts. Pass nil for opts to use the defaults.
+func NewFeedbackToolWithOptions(opts *Options) mcp.Tool {
+	annotations := defaultAnnotations()
+	if opts != nil && opts.ToolAnnotations != nil {
+		annotations = *opts.ToolAnnotations
+	}
+	description := ToolDescription
+	if opts != nil && opts.UseShortDescription {
+		description = ToolDescriptionShort
+	}
 	return mcp.NewTool(ToolName,
-		mcp.WithDescription(ToolDescription),
+		mcp.WithDescription(description),
+		mcp.WithToolAnnotation(annotations),
 		mcp.WithString("what_i_needed",
 			mcp.Required(),
 			mcp.Description("What capability, data, or tool were you looking for?"),
@@ -104,7 +487,7 @@ func NewFeedbackTool() mcp.Tool {
 		),
 		mcp.WithString("gap_type",
 			mcp.Required(),
-			mcp.Description("The category of gap: missing_tool, incomplete_results, missing_parameter, wrong_format, other"),
+			mcp.Description("The category of gap: missing_tool, incomplete_results, missing_parameter, wrong_format, other. If several apply, list them comma-separated, most important first."),
 		),
 		mcp.WithString("suggestion",
 			mcp.Description("Your idea for what would have helped — inputs, outputs, behavior."),
@@ -130,180 +513,4874 @@ func NewFeedbackTool() mcp.Tool {
 		mcp.WithString("tools_available",
 			mcp.Description("Comma-separated list of tool names you considered or tried."),
 		),
+		mcp.WithString("expected_tool",
+			mcp.Description("For missing_tool: the name of the tool you wished existed, e.g. search_invoices."),
+		),
+		mcp.WithString("duplicate_of",
+			mcp.Description("If you already filed similar feedback, the ID of that earlier submission."),
+		),
+		mcp.WithString("follows_up_on",
+			mcp.Description("If this adds new information to a gap you reported earlier, the ID of that earlier submission."),
+		),
+		mcp.WithString("recent_errors",
+			mcp.Description("Comma-separated recent tool errors that led to this gap, if any. Up to 5."),
+		),
+		mcp.WithString("references",
+			mcp.Description("Comma-separated URLs or IDs of artifacts that prompted this gap (a generated file, screenshot path, log excerpt ID). Up to 10."),
+		),
+		mcp.WithString("expires_at",
+			mcp.Description("Optional RFC 3339 time after which this feedback is no longer relevant (e.g. the end of a release cycle)."),
+		),
+		mcp.WithNumber("ttl_seconds",
+			mcp.Description("Optional alternative to expires_at: seconds from now until this feedback is no longer relevant."),
+		),
+		mcp.WithString("priority",
+			mcp.Description("low, normal (default), or high. Use high only for safety-relevant gaps."),
+			mcp.Enum(priorityLow, priorityNormal, priorityHigh),
+		),
+		mcp.WithString("meta_note",
+			mcp.Description("Optional: anything about this feedback tool itself that was confusing or hard to use. Filed separately from the gap above."),
+		),
 	)
 }
 
+// ToolInputSchema returns the JSON schema of the tool's input, for client-side
+// validators and documentation generators. It is derived from NewFeedbackTool
+// so the two cannot drift.
+func ToolInputSchema() json.RawMessage {
+	schema, err := json.Marshal(NewFeedbackTool().InputSchema)
+	if err != nil {
+		panic("feedback: encoding tool input schema: " + err.Error())
+	}
+	return schema
+}
+
 // ── Feedback Submission ─────────────────────────────────────────────────────
 
-type feedbackPayload struct {
-	ServerName   string   `json:"server_name"`
-	WhatINeeded  string   `json:"what_i_needed"`
-	WhatITried   string   `json:"what_i_tried"`
-	GapType      string   `json:"gap_type"`
-	Suggestion   string   `json:"suggestion"`
-	UserGoal     string   `json:"user_goal"`
-	Resolution   string   `json:"resolution"`
-	AgentModel   string   `json:"agent_model"`
-	SessionID    string   `json:"session_id"`
-	ClientType   string   `json:"client_type"`
-	ToolsAvail   []string `json:"tools_available"`
+// Feedback is the payload posted to the sidecar, as built from the tool's
+// arguments. BuildPayload returns one without sending it.
+type Feedback struct {
+	ServerName  string   `json:"server_name"`
+	WhatINeeded string   `json:"what_i_needed"`
+	WhatITried  string   `json:"what_i_tried"`
+	GapType     string   `json:"gap_type"`
+	Suggestion  string   `json:"suggestion"`
+	UserGoal    string   `json:"user_goal"`
+	Resolution  string   `json:"resolution"`
+	AgentModel  string   `json:"agent_model"`
+	SessionID   string   `json:"session_id"`
+	ClientType  string   `json:"client_type"`
+	ToolsAvail  []string `json:"tools_available"`
+	// GapTypes lists every gap type when the agent gave more than one;
+	// GapType holds the first (primary) for older sidecars.
+	GapTypes []string `json:"gap_types,omitempty"`
+	// ExpectedTool names the tool the agent wished existed (missing_tool).
+	ExpectedTool string `json:"expected_tool,omitempty"`
+	// ContextHash is a host-supplied hash of the conversation context, for
+	// grouping on the sidecar; see WithContextHash.
+	ContextHash string `json:"context_hash,omitempty"`
+	// ClientTypeRaw is what the agent sent when client_type wasn't a known
+	// client and was bucketed as "other".
+	ClientTypeRaw string `json:"client_type_raw,omitempty"`
+	// ExpiresAt (RFC 3339, UTC) tells the sidecar when it may expire the
+	// record.
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// Priority is low, normal, or high; see parsePriority.
+	Priority string `json:"priority,omitempty"`
+	// DuplicateOf is the ID of earlier feedback this one repeats.
+	DuplicateOf string `json:"duplicate_of,omitempty"`
+	// FollowsUpOn is the ID of earlier feedback this one adds to. Unlike
+	// DuplicateOf, it is a full record in its own right.
+	FollowsUpOn string `json:"follows_up_on,omitempty"`
+	// RecentErrors are recent tool-call errors from the session.
+	RecentErrors []string `json:"recent_errors,omitempty"`
+	// ToolsByCategory summarizes ToolsAvail via Options.ToolClassifier.
+	ToolsByCategory map[string]int `json:"tools_by_category,omitempty"`
+	// References are URLs or opaque IDs of artifacts behind the gap.
+	References []string `json:"references,omitempty"`
+	// Tags are static labels from Options.Tags merged with WithTags.
+	Tags map[string]string `json:"tags,omitempty"`
+	// MCPRequestID joins the record to host-side request logs.
+	MCPRequestID string `json:"mcp_request_id,omitempty"`
+	// FieldSizes holds approximate word counts of the long free-text fields,
+	// taken before truncation, via Options.IncludeFieldSizes.
+	FieldSizes map[string]int `json:"field_sizes,omitempty"`
+	// BuildID identifies the deployed build of the host server.
+	BuildID string `json:"build_id,omitempty"`
+	// InstallID is a random, persistent per-install ID; see
+	// Options.IncludeInstallID.
+	InstallID string `json:"install_id,omitempty"`
+	// SessionSeq numbers this submission within its session (1 for the
+	// first). It restarts if the session is evicted from tracking; see
+	// Options.MaxTrackedSessions.
+	SessionSeq int `json:"session_seq,omitempty"`
+	// ProcessUptimeMS and SubmissionSeq (1 for the process's first
+	// submission) are set by Options.IncludeProcessStats.
+	ProcessUptimeMS int64 `json:"process_uptime_ms,omitempty"`
+	SubmissionSeq   int64 `json:"submission_seq,omitempty"`
+	// ClientTimestamp is when the feedback was filed (RFC 3339, UTC), so
+	// late deliveries and spool expiry reflect when the gap occurred.
+	ClientTimestamp string `json:"client_timestamp,omitempty"`
+	// IdempotencyKey identifies this submission across retries and replays;
+	// also sent as the Idempotency-Key header.
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// ClientWarnings records anything the drop-in had to fix up in the
+	// agent's arguments, so the sidecar can spot misbehaving clients.
+	ClientWarnings []string `json:"client_warnings,omitempty"`
+}
+
+// namedField is a pointer to one of the agent-supplied string fields.
+type namedField struct {
+	name string
+	val  *string
+}
+
+// textFields lists the agent-supplied string fields of p, keyed by JSON name.
+func (p *Feedback) textFields() []namedField {
+	return []namedField{
+		{"what_i_needed", &p.WhatINeeded},
+		{"what_i_tried", &p.WhatITried},
+		{"gap_type", &p.GapType},
+		{"suggestion", &p.Suggestion},
+		{"user_goal", &p.UserGoal},
+		{"resolution", &p.Resolution},
+		{"agent_model", &p.AgentModel},
+		{"session_id", &p.SessionID},
+		{"client_type", &p.ClientType},
+	}
+}
+
+// contentKey derives a stable idempotency key from what the agent reported, so
+// an agent that re-invokes the tool with the same arguments reuses the key.
+// Per-call values like the request ID and warnings are deliberately excluded.
+func (p *Feedback) contentKey() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "server_name=%q\n", p.ServerName)
+	for _, f := range p.textFields() {
+		fmt.Fprintf(h, "%s=%q\n", f.name, *f.val)
+	}
+	fmt.Fprintf(h, "tools_available=%q\nreferences=%q\n", p.ToolsAvail, p.References)
+	return hex.EncodeToString(h.Sum(nil)[:16])
 }
 
-func getString(args map[string]any, key string) string {
-	if v, ok := args[key]; ok {
-		if s, ok := v.(string); ok {
-			return s
+// requiredFields are always sent, even when empty.
+var requiredFields = []string{"server_name", "what_i_needed", "what_i_tried", "gap_type"}
+
+// encodePayload produces the request body for p. With Options.OmitEmpty,
+// optional fields that are empty ("", null, [], {}) are left out entirely,
+// for sidecars whose validators reject explicit empty values. Keys are then
+// renamed by Options.FieldNameMap.
+func encodePayload(p *Feedback, opts *Options) ([]byte, error) {
+	marshal := opts.marshal()
+	body, err := marshal(p)
+	if err != nil || opts == nil || !opts.OmitEmpty && len(opts.FieldNameMap) == 0 {
+		return body, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	if opts.OmitEmpty {
+		for k, v := range fields {
+			if slices.Contains(requiredFields, k) {
+				continue
+			}
+			switch string(v) {
+			case `""`, "null", "[]", "{}":
+				delete(fields, k)
+			}
 		}
 	}
-	return ""
+	if len(opts.FieldNameMap) > 0 {
+		if fields, err = renameFields(fields, opts.FieldNameMap); err != nil {
+			return nil, err
+		}
+	}
+	return marshal(fields)
 }
 
-// Options configures the feedback tool's sidecar connection.
-// Pass to RegisterFeedbackTool or SendFeedback to override env vars.
-type Options struct {
-	// SidecarURL overrides FEEDBACK_SIDECAR_URL.
-	SidecarURL string
-	// APIKey overrides FEEDBACK_API_KEY.
-	APIKey string
+// renameFields returns fields with keys renamed by names. It fails rather
+// than let two fields land on the same key.
+func renameFields(fields map[string]json.RawMessage, names map[string]string) (map[string]json.RawMessage, error) {
+	renamed := make(map[string]json.RawMessage, len(fields))
+	from := make(map[string]string, len(fields))
+	for _, k := range slices.Sorted(maps.Keys(fields)) {
+		to := k
+		if n, ok := names[k]; ok && n != "" {
+			to = n
+		}
+		if prev, dup := from[to]; dup {
+			return nil, fmt.Errorf("FieldNameMap: %s and %s both map to %q", prev, k, to)
+		}
+		from[to] = k
+		renamed[to] = fields[k]
+	}
+	return renamed, nil
 }
 
-func (o *Options) url() string {
-	if o != nil && o.SidecarURL != "" {
-		return o.SidecarURL
+// asLinkRecord strips p down to a lightweight record pointing at DuplicateOf:
+// enough to count and attribute the repeat, without duplicating its content.
+func (p *Feedback) asLinkRecord() {
+	p.WhatITried = ""
+	p.Suggestion = ""
+	p.UserGoal = ""
+	p.ToolsAvail = nil
+	p.ToolsByCategory = nil
+	p.References = nil
+	p.RecentErrors = nil
+}
+
+// feedbackIDPattern loosely matches sidecar feedback IDs (UUIDs today) while
+// tolerating other ID schemes.
+var feedbackIDPattern = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._:-]{0,127}$`)
+
+// feedbackRef reads a reference to a prior feedback ID, dropping it with a
+// warning if it doesn't look like an ID.
+func feedbackRef(args map[string]any, key string, warnings *[]string) string {
+	id := strings.TrimSpace(getString(args, key, warnings))
+	if id != "" && !feedbackIDPattern.MatchString(id) {
+		*warnings = append(*warnings, fmt.Sprintf("%s: dropped %.64q (not a feedback ID)", key, id))
+		return ""
 	}
-	return sidecarURL
+	return id
 }
 
-func (o *Options) key() string {
-	if o != nil && o.APIKey != "" {
-		return o.APIKey
+// toolNamePattern matches plausible tool identifiers.
+var toolNamePattern = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9_.-]{0,63}$`)
+
+// expectedTool reads expected_tool, dropping it with a warning unless it
+// looks like a tool name.
+func expectedTool(args map[string]any, warnings *[]string) string {
+	name := strings.TrimSpace(getString(args, "expected_tool", warnings))
+	if name != "" && !toolNamePattern.MatchString(name) {
+		*warnings = append(*warnings, fmt.Sprintf("expected_tool: dropped %.64q (not a tool name)", name))
+		return ""
 	}
-	return apiKey
+	return name
 }
 
-// SendFeedback posts feedback to the sidecar with retry logic.
-//
-// Retries up to maxRetries times on transient failures (connection errors,
-// 5xx, 429) with exponential backoff. Uses a module-level http.Client for
-// connection pooling. Best-effort — returns a message regardless of outcome.
-// Pass nil for opts to use environment variable defaults.
-func SendFeedback(ctx context.Context, args map[string]any, serverName string, opts *Options) string {
-	// Parse tools_available — accept comma-separated string or []any
-	var tools []string
-	switch v := args["tools_available"].(type) {
+// defaultFieldLimits are the per-field byte budgets applied before sending.
+var defaultFieldLimits = map[string]int{
+	"what_i_needed": 2000,
+	"what_i_tried":  4000,
+	"gap_type":      64,
+	"suggestion":    4000,
+	"user_goal":     4000,
+	"resolution":    64,
+	"agent_model":   128,
+	"session_id":    256,
+	"client_type":   128,
+}
+
+// applyFieldLimits truncates over-limit fields on rune boundaries, recording
+// a client warning for each. Options.FieldLimits entries override the
+// defaults; a limit of zero or less disables truncation for that field.
+func applyFieldLimits(p *Feedback, opts *Options) {
+	for _, f := range p.textFields() {
+		limit := defaultFieldLimits[f.name]
+		if opts != nil {
+			if l, ok := opts.FieldLimits[f.name]; ok {
+				limit = l
+			}
+		}
+		if limit <= 0 || len(*f.val) <= limit {
+			continue
+		}
+		orig := len(*f.val)
+		*f.val = truncateRunes(*f.val, limit)
+		p.ClientWarnings = append(p.ClientWarnings, fmt.Sprintf("%s: truncated from %d to %d bytes", f.name, orig, len(*f.val)))
+	}
+}
+
+// truncateRunes cuts s to at most n bytes without splitting a UTF-8 sequence.
+func truncateRunes(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
+
+// stripANSI removes terminal escape sequences from s: CSI sequences (ESC [
+// or the 8-bit CSI, through the final byte), OSC strings (through BEL or
+// ESC \), and two-byte ESC sequences. A lone ESC is dropped; all other text
+// is kept. Reports whether anything was removed.
+func stripANSI(s string) (string, bool) {
+	if !strings.ContainsRune(s, 0x1b) && !strings.ContainsRune(s, 0x9b) {
+		return s, false
+	}
+	var b strings.Builder
+	b.Grow(len(s))
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == 0x9b: // 8-bit CSI
+			i = skipCSI(s, i+size)
+		case r != 0x1b:
+			b.WriteString(s[i : i+size])
+			i += size
+		case i+1 >= len(s):
+			i++
+		case s[i+1] == '[':
+			i = skipCSI(s, i+2)
+		case s[i+1] == ']':
+			i = skipOSC(s, i+2)
+		case s[i+1] >= 0x40 && s[i+1] <= 0x5f:
+			i += 2
+		default:
+			i++
+		}
+	}
+	return b.String(), true
+}
+
+// skipCSI returns the index just past the CSI sequence whose parameters
+// start at i: parameter bytes 0x30-0x3F, intermediates 0x20-0x2F, then one
+// final byte 0x40-0x7E. A malformed sequence ends at the first byte that
+// doesn't fit, which is kept.
+func skipCSI(s string, i int) int {
+	for i < len(s) && s[i] >= 0x30 && s[i] <= 0x3f {
+		i++
+	}
+	for i < len(s) && s[i] >= 0x20 && s[i] <= 0x2f {
+		i++
+	}
+	if i < len(s) && s[i] >= 0x40 && s[i] <= 0x7e {
+		i++
+	}
+	return i
+}
+
+// skipOSC returns the index just past the OSC string starting at i, which is
+// terminated by BEL or ESC \ (or the end of s).
+func skipOSC(s string, i int) int {
+	for i < len(s) {
+		switch {
+		case s[i] == 0x07:
+			return i + 1
+		case s[i] == 0x1b && i+1 < len(s) && s[i+1] == '\\':
+			return i + 2
+		}
+		i++
+	}
+	return i
+}
+
+// applyStripANSI strips escape sequences from the agent-supplied text and
+// recent errors, noting each field it changed in client_warnings.
+func applyStripANSI(p *Feedback) {
+	for _, f := range p.textFields() {
+		if out, ok := stripANSI(*f.val); ok {
+			*f.val = out
+			p.ClientWarnings = append(p.ClientWarnings, f.name+": stripped ANSI escape sequences")
+		}
+	}
+	stripped := false
+	for i, e := range p.RecentErrors {
+		if out, ok := stripANSI(e); ok {
+			p.RecentErrors[i], stripped = out, true
+		}
+	}
+	if stripped {
+		p.ClientWarnings = append(p.ClientWarnings, "recent_errors: stripped ANSI escape sequences")
+	}
+}
+
+// RedactionRule replaces every match of Pattern in outgoing text with
+// Replacement, which may use $1-style group references.
+type RedactionRule struct {
+	Pattern     *regexp.Regexp
+	Replacement string
+}
+
+// LoadRedactionRules reads rules from a JSON file of the form
+// [{"pattern": "...", "replacement": "..."}], so they can be maintained
+// outside the code. Every pattern is compiled up front; the first invalid
+// one is returned as an error rather than skipped.
+func LoadRedactionRules(path string) ([]RedactionRule, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var raw []struct {
+		Pattern     string `json:"pattern"`
+		Replacement string `json:"replacement"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	rules := make([]RedactionRule, 0, len(raw))
+	for i, r := range raw {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("%s: rule %d: %w", path, i, err)
+		}
+		rules = append(rules, RedactionRule{Pattern: re, Replacement: r.Replacement})
+	}
+	return rules, nil
+}
+
+// applyRedaction runs every rule over the agent-supplied text, recent errors,
+// and references.
+func applyRedaction(p *Feedback, rules []RedactionRule) {
+	redact := func(s string) string {
+		for _, r := range rules {
+			s = r.Pattern.ReplaceAllString(s, r.Replacement)
+		}
+		return s
+	}
+	for _, f := range p.textFields() {
+		*f.val = redact(*f.val)
+	}
+	for i := range p.RecentErrors {
+		p.RecentErrors[i] = redact(p.RecentErrors[i])
+	}
+	for i := range p.References {
+		p.References[i] = redact(p.References[i])
+	}
+}
+
+// getList parses a list argument, accepting a comma-separated string, []any,
+// or []string.
+func getList(args map[string]any, key string) []string {
+	var list []string
+	switch v := args[key].(type) {
+	case []string:
+		list = slices.Clone(v)
 	case string:
 		if v != "" {
 			for _, t := range bytes.Split([]byte(v), []byte(",")) {
-				tools = append(tools, string(bytes.TrimSpace(t)))
+				list = append(list, string(bytes.TrimSpace(t)))
 			}
 		}
 	case []any:
 		for _, t := range v {
 			if s, ok := t.(string); ok {
-				tools = append(tools, s)
+				list = append(list, s)
 			}
 		}
 	}
+	return list
+}
 
-	payload := feedbackPayload{
-		ServerName:  serverName,
-		WhatINeeded: getString(args, "what_i_needed"),
-		WhatITried:  getString(args, "what_i_tried"),
-		GapType:     getString(args, "gap_type"),
-		Suggestion:  getString(args, "suggestion"),
-		UserGoal:    getString(args, "user_goal"),
-		Resolution:  getString(args, "resolution"),
-		AgentModel:  getString(args, "agent_model"),
-		SessionID:   getString(args, "session_id"),
-		ClientType:  getString(args, "client_type"),
-		ToolsAvail:  tools,
+// gapTypes are the categories the tool schema offers for gap_type.
+var gapTypes = []string{"missing_tool", "incomplete_results", "missing_parameter", "wrong_format", "other"}
+
+// parseGapTypes reads gap_type as a single value, a comma-separated list, or
+// an array. A single value passes through unchecked, as before; from a list,
+// values outside gapTypes are dropped with a warning and duplicates removed.
+// The first remaining value is the primary.
+func parseGapTypes(args map[string]any, warnings *[]string) (string, []string) {
+	switch args["gap_type"].(type) {
+	case string, []any:
+	default:
+		return getString(args, "gap_type", warnings), nil
 	}
-	if payload.GapType == "" {
-		payload.GapType = "other"
+	raw := getList(args, "gap_type")
+	if len(raw) <= 1 {
+		return strings.Join(raw, ""), nil
 	}
-
-	body, err := json.Marshal(payload)
-	if err != nil {
-		return "Feedback noted (encoding error)."
+	var types []string
+	for _, t := range raw {
+		t = strings.ToLower(strings.TrimSpace(t))
+		switch {
+		case t == "" || slices.Contains(types, t):
+		case slices.Contains(gapTypes, t):
+			types = append(types, t)
+		default:
+			*warnings = append(*warnings, fmt.Sprintf("gap_type: dropped unknown type %.32q", t))
+		}
+	}
+	switch len(types) {
+	case 0:
+		return "other", nil
+	case 1:
+		return types[0], nil
 	}
+	return types[0], types
+}
 
-	endpoint := opts.url() + "/api/feedback"
-	authKey := opts.key()
-	var lastErr error
+// ToolsPrecedence selects how host- and agent-supplied tool lists combine.
+type ToolsPrecedence int
 
-	for attempt := 0; attempt <= maxRetries; attempt++ {
-		req, err := http.NewRequestWithContext(ctx, "POST", endpoint, bytes.NewReader(body))
-		if err != nil {
-			return "Feedback noted (sidecar unavailable, but your input is appreciated)."
-		}
-		req.Header.Set("Content-Type", "application/json")
-		req.Header.Set("User-Agent", userAgent)
-		if authKey != "" {
-			req.Header.Set("Authorization", "Bearer "+authKey)
-		}
+const (
+	// ToolsHostWins sends the host's list when there is one, ignoring the
+	// agent's.
+	ToolsHostWins ToolsPrecedence = iota
+	// ToolsMerge sends the host's list followed by any tools only the agent
+	// named, without duplicates.
+	ToolsMerge
+)
 
-		resp, err := httpClient.Do(req)
-		if err != nil {
-			lastErr = err
-			if attempt < maxRetries {
-				backoff := time.Duration(float64(initialBackoff) * math.Pow(2, float64(attempt)))
-				select {
-				case <-ctx.Done():
-					logUnsentPayload(body, fmt.Sprintf("unreachable:%v", err))
-					return "Feedback could not be delivered and was logged. (Server unreachable)"
-				case <-time.After(backoff):
-				}
-				continue
-			}
-			break
-		}
-		// Drain body so the connection can be reused.
-		io.Copy(io.Discard, resp.Body)
-		resp.Body.Close()
+type toolsContextKey struct{}
+
+// WithToolsAvailable returns a context carrying the host's own list of the
+// tools the agent could see, which is more reliable than the agent's
+// tools_available argument. Options.ToolsPrecedence decides how the two
+// combine.
+func WithToolsAvailable(ctx context.Context, tools []string) context.Context {
+	return context.WithValue(ctx, toolsContextKey{}, tools)
+}
 
-		if resp.StatusCode == 201 {
-			return "Thank you. Your feedback has been recorded and will be used to improve this server's capabilities."
+// resolveTools returns tools_available: the agent's list, the host's, or
+// both, per Options.ToolsPrecedence. The result is the same whatever form
+// (string or array) the agent's argument took.
+func resolveTools(ctx context.Context, args map[string]any, opts *Options) []string {
+	agent := getList(args, "tools_available")
+	host, ok := ctx.Value(toolsContextKey{}).([]string)
+	if !ok {
+		return agent
+	}
+	if opts == nil || opts.ToolsPrecedence != ToolsMerge {
+		return slices.Clone(host)
+	}
+	var tools []string
+	for _, t := range slices.Concat(host, agent) {
+		if t != "" && !slices.Contains(tools, t) {
+			tools = append(tools, t)
 		}
-		if isRetryableStatus(resp.StatusCode) && attempt < maxRetries {
-			backoff := time.Duration(float64(initialBackoff) * math.Pow(2, float64(attempt)))
-			select {
-			case <-ctx.Done():
-				logUnsentPayload(body, fmt.Sprintf("status_%d", resp.StatusCode))
-				return fmt.Sprintf("Feedback could not be delivered and was logged. (Server returned %d)", resp.StatusCode)
-			case <-time.After(backoff):
-			}
-			continue
+	}
+	return tools
+}
+
+// classifyTools counts tools per category. Tools the classifier leaves
+// uncategorized are counted under "other".
+func classifyTools(tools []string, classify func(string) string) map[string]int {
+	if len(tools) == 0 {
+		return nil
+	}
+	counts := make(map[string]int)
+	for _, t := range tools {
+		category := classify(t)
+		if category == "" {
+			category = "other"
 		}
-		logUnsentPayload(body, fmt.Sprintf("status_%d", resp.StatusCode))
-		return fmt.Sprintf("Feedback could not be delivered and was logged. (Server returned %d)", resp.StatusCode)
+		counts[category]++
 	}
+	return counts
+}
 
-	logUnsentPayload(body, fmt.Sprintf("unreachable:%v", lastErr))
-	return "Feedback could not be delivered and was logged. (Server unreachable)"
+// defaultClientTypes are the client_type values kept as-is after
+// normalization; anything else is reported as "other".
+var defaultClientTypes = []string{
+	"claude-desktop", "claude-code", "cursor", "vscode", "windsurf", "cline", "zed", "continue",
 }
 
-// ── Handler & Registration ──────────────────────────────────────────────────
+// defaultClientAliases maps common spellings, after normalization, to their
+// canonical client_type.
+var defaultClientAliases = map[string]string{
+	"claude":             "claude-desktop",
+	"claude-app":         "claude-desktop",
+	"claudecode":         "claude-code",
+	"claude-cli":         "claude-code",
+	"vs-code":            "vscode",
+	"visual-studio-code": "vscode",
+	"roo-cline":          "cline",
+}
 
-// NewFeedbackHandler returns a tool handler function bound to a server name.
-// Pass nil for opts to use environment variable defaults.
-func NewFeedbackHandler(serverName string, opts *Options) server.ToolHandlerFunc {
-	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
-		args := req.GetArguments()
-		msg := SendFeedback(ctx, args, serverName, opts)
-		return mcp.NewToolResultText(msg), nil
+// normalizeClientType lowercases raw and joins words with hyphens, resolves
+// aliases, and checks the result against the allowlist. Unknown clients come
+// back as "other" with known false so the caller can keep the raw value.
+func normalizeClientType(raw string, opts *Options) (clientType string, known bool) {
+	ct := strings.Join(strings.FieldsFunc(strings.ToLower(raw), func(r rune) bool {
+		return r == ' ' || r == '_' || r == '-'
+	}), "-")
+	if ct == "" {
+		return "", true
+	}
+	if alias, ok := opts.clientAliases()[ct]; ok {
+		ct = alias
+	}
+	if !slices.Contains(opts.clientTypes(), ct) {
+		return "other", false
 	}
+	return ct, true
 }
 
-// RegisterFeedbackTool is a one-liner to add the feedback tool to an MCP server.
-// Pass nil for opts to use environment variable defaults.
-//
-//	s := server.NewMCPServer("my-server", "1.0.0")
-//	feedback.RegisterFeedbackTool(s, "my-server", nil)
-//
-//	// Or point at a specific sidecar:
-//	feedback.RegisterFeedbackTool(s, "my-server", &feedback.Options{
-//	    SidecarURL: "https://feedback.prod.example.com",
-//	})
-func RegisterFeedbackTool(s *server.MCPServer, serverName string, opts *Options) {
-	s.AddTool(NewFeedbackTool(), NewFeedbackHandler(serverName, opts))
+const (
+	maxReferences   = 10
+	maxReferenceLen = 2048
+)
+
+// boundReferences drops empty references, ones longer than maxReferenceLen,
+// and any beyond maxReferences, recording a warning for each drop.
+func boundReferences(refs []string, warnings *[]string) []string {
+	var kept []string
+	for _, r := range refs {
+		switch {
+		case r == "":
+		case len(r) > maxReferenceLen:
+			*warnings = append(*warnings, fmt.Sprintf("references: dropped one over %d bytes", maxReferenceLen))
+		case len(kept) >= maxReferences:
+			*warnings = append(*warnings, fmt.Sprintf("references: dropped %q (more than %d)", r, maxReferences))
+		default:
+			kept = append(kept, r)
+		}
+	}
+	return kept
+}
+
+// getString returns args[key] as a string. Clients that ignore the schema
+// sometimes send numbers or bools (e.g. a numeric session_id); those scalars
+// are converted rather than dropped, and a warning is appended to warnings.
+func getString(args map[string]any, key string, warnings *[]string) string {
+	v, ok := args[key]
+	if !ok || v == nil {
+		return ""
+	}
+	var s string
+	switch v := v.(type) {
+	case string:
+		return v
+	case float64:
+		s = strconv.FormatFloat(v, 'f', -1, 64)
+	case bool:
+		s = strconv.FormatBool(v)
+	case json.Number:
+		s = v.String()
+	case int, int32, int64, uint, uint32, uint64, float32:
+		s = fmt.Sprint(v)
+	default:
+		*warnings = append(*warnings, fmt.Sprintf("%s: dropped non-scalar %T value", key, v))
+		return ""
+	}
+	*warnings = append(*warnings, fmt.Sprintf("%s: coerced %T to string", key, v))
+	return s
+}
+
+// Options configures the feedback tool's sidecar connection.
+// Pass to RegisterFeedbackTool or SendFeedback to override env vars.
+type Options struct {
+	// SidecarURL overrides FEEDBACK_SIDECAR_URL.
+	SidecarURL string
+	// EnvRouting maps environment names to sidecar URLs, so one binary run
+	// as dev, staging, and prod reports to the matching sidecar. The name is
+	// read from FEEDBACK_ENV; an unmapped or unset name falls back to
+	// SidecarURL.
+	EnvRouting map[string]string
+	// APIKey overrides FEEDBACK_API_KEY. A key attached with WithAPIKey
+	// takes precedence over both.
+	APIKey string
+	// APIKeyFile reads the key from a file (e.g. a mounted Kubernetes
+	// secret), overriding FEEDBACK_API_KEY_FILE. APIKey wins when both are
+	// set. The file is re-read whenever it changes, so rotation needs no
+	// restart.
+	APIKeyFile string
+	// Timeout bounds each request to the sidecar. Default: 5s.
+	Timeout time.Duration
+	// TLSConfig customizes TLS to the sidecar, e.g. a private CA or a client
+	// certificate. Reuse one *tls.Config: connections are pooled per config.
+	TLSConfig *tls.Config
+	// Authenticator sets credentials on each sidecar request for endpoints
+	// that don't take a Bearer token (see BasicAuth, HeaderAuth). When set,
+	// it replaces APIKey, WithAPIKey, and FEEDBACK_API_KEY entirely.
+	Authenticator Authenticator
+	// BuildID tags every submission with the host's build (e.g. a commit
+	// SHA). Default: the environment variable named by BuildIDEnv.
+	BuildID string
+	// BuildIDEnv names the environment variable BuildID is read from.
+	// Default: BUILD_SHA, falling back to GIT_SHA.
+	BuildIDEnv string
+	// IncludeInstallID adds install_id: a random ID generated on first use
+	// and persisted at InstallIDPath, so the sidecar can count distinct
+	// installs without identifying them. Opt-in.
+	IncludeInstallID bool
+	// IncludeProcessStats adds process_uptime_ms and submission_seq, a
+	// per-process counter, so the sidecar can correlate bursts of feedback
+	// with restarts.
+	IncludeProcessStats bool
+	// InstallIDPath is where the install ID is kept. Default:
+	// patchworkmcp/install_id under os.UserConfigDir.
+	InstallIDPath string
+	// WeightedEndpoints splits submissions across several sidecars, e.g.
+	// 10% to a canary and 90% to stable. Each submission picks one by
+	// weight and sends all its retries there. SidecarURL is still used for
+	// health probes and schema checks. Default: SidecarURL only.
+	WeightedEndpoints []WeightedURL
+	// ShadowURL mirrors every delivery to a second sidecar, e.g. during a
+	// migration. Shadow sends run in the background with their own retries
+	// and never affect the result; their failures are only logged, at debug
+	// level, when DebugLog is set. They count toward InflightCount and
+	// share the background send slots.
+	ShadowURL string
+	// ShadowAPIKey is the Bearer token for ShadowURL. The primary's
+	// credentials are never sent to the shadow; without this or
+	// ShadowAuthenticator, shadow requests are unauthenticated.
+	ShadowAPIKey string
+	// ShadowAuthenticator sets credentials on shadow requests, in place of
+	// ShadowAPIKey.
+	ShadowAuthenticator Authenticator
+	// URLProvider supplies the full URL each submission is sent to, e.g. a
+	// short-lived presigned upload URL from an auth service, in place of
+	// SidecarURL/api/feedback. The URL is used as-is, cached for
+	// URLProviderTTL, and fetched again after a 403. SidecarURL is still used
+	// for health probes and schema checks.
+	URLProvider func(ctx context.Context) (string, error)
+	// URLProviderTTL is how long a URL from URLProvider is reused.
+	// Default: 1m.
+	URLProviderTTL time.Duration
+	// SpoolPath overrides FEEDBACK_SPOOL_PATH. When set, undeliverable
+	// feedback is appended here instead of logged, for ReplaySpool.
+	SpoolPath string
+	// SpoolMaxAge, when set, expires spooled feedback filed longer ago than
+	// this, both during replay and in an hourly background sweep, so a
+	// recovered sidecar isn't flooded with stale records.
+	SpoolMaxAge time.Duration
+	// ReplayMaxDuration bounds one ReplaySpool or RedriveSpool run; entries
+	// not reached in time stay spooled for the next run. Zero means no limit
+	// beyond the caller's context.
+	ReplayMaxDuration time.Duration
+	// ReplayMaxItems bounds how many entries one replay run attempts. Zero
+	// means all of them.
+	ReplayMaxItems int
+	// ReplayQuickFail gives each entry a single attempt during replay
+	// instead of the usual retries, since the spool as a whole is replayed
+	// again later.
+	ReplayQuickFail bool
+	// LinkDuplicates sends a lightweight link record instead of a full
+	// submission when the agent sets duplicate_of, keeping repeats out of
+	// the sidecar's dataset while still counting them.
+	LinkDuplicates bool
+	// ResultCacheTTL, when set, remembers delivered results by idempotency
+	// key for this long so identical repeat calls return the first result
+	// without contacting the sidecar again.
+	ResultCacheTTL time.Duration
+	// MaxTrackedSessions caps how many distinct session_ids the drop-in
+	// keeps per-session state for, across all Options. When full, the least
+	// recently active session is evicted and its counters (e.g. session_seq)
+	// start again from zero if it returns. Default: 1024.
+	MaxTrackedSessions int
+	// RequireSessionID refuses submissions without a session_id, asking the
+	// agent to resend with one, so every record is attributable. Enable it
+	// only when the host reliably provides session IDs; otherwise agents
+	// that have none can't file feedback at all. Records the host files
+	// itself (ReportMissingTool, heartbeats) are exempt.
+	RequireSessionID bool
+	// DebounceInterval, when set, holds each submission for this long and
+	// sends only the latest one per session+gap_type. Submissions without a
+	// session_id are sent immediately. Call Close on shutdown to flush.
+	DebounceInterval time.Duration
+	// BatchSize, when set, queues submissions and sends them from the
+	// background once this many have accumulated. Call Close on shutdown to
+	// flush.
+	BatchSize int
+	// FlushInterval, with BatchSize, also sends whatever is queued at this
+	// interval, so sparse traffic isn't held waiting for a full batch.
+	FlushInterval time.Duration
+	// QueueCapacity bounds how many submissions the batch queue holds while
+	// deliveries are backed up, e.g. during a sidecar outage. Default: 1000.
+	QueueCapacity int
+	// QueuePolicy decides what happens when the queue is at QueueCapacity.
+	// Every drop is logged with its gap_type and counted in the status
+	// resource. Default: DropOldest.
+	QueuePolicy QueuePolicy
+	// SkippedMessage is returned to the agent when a submission is shed
+	// under load rather than sent. Keep it an acknowledgement: a message
+	// that reads like a failure invites the agent to retry and adds load.
+	// Default: a note that similar feedback was already captured.
+	SkippedMessage string
+	// HealthProbeInterval, when set, starts a background Ping of the sidecar
+	// at this interval. While the last probe reports it down, submissions are
+	// logged immediately instead of retried. Ignored with a custom
+	// Transport. Call Close to stop the probe.
+	HealthProbeInterval time.Duration
+	// HealthStaleness is how long a failed probe result is trusted.
+	// Default: twice HealthProbeInterval.
+	HealthStaleness time.Duration
+	// HeartbeatInterval, when set, makes RegisterFeedbackTool submit a
+	// synthetic gap_type=heartbeat record (tagged synthetic=heartbeat) at
+	// this interval, so monitoring can alert when feedback stops flowing.
+	// Call Close to stop it.
+	HeartbeatInterval time.Duration
+	// ExposeStatusResource makes RegisterFeedbackTool also register a
+	// read-only feedback://status MCP resource summarizing delivery health
+	// and configuration (never credentials).
+	ExposeStatusResource bool
+	// SchemaPreflight checks the sidecar's /api/schema once at registration,
+	// in the background, and logs a warning for any field mismatch. It never
+	// blocks or fails registration.
+	SchemaPreflight bool
+	// UseShortDescription advertises ToolDescriptionShort instead of the
+	// full ToolDescription, saving context in hosts with many tools.
+	UseShortDescription bool
+	// ToolAnnotations overrides the hints the feedback tool advertises to hosts
+	// (read-only, non-destructive, idempotent by default).
+	ToolAnnotations *mcp.ToolAnnotation
+	// Tags are static labels (team=payments, tier=prod) sent with every
+	// submission as a "tags" object. Keys are limited to 64 bytes, values to
+	// 256, and at most 32 tags are sent. Per-call WithTags values override.
+	Tags map[string]string
+	// ToolClassifier maps a tool name to a category (e.g. "billing_*" →
+	// "billing"). When set, tools_available is also summarized as a
+	// tools_by_category count map for large servers.
+	ToolClassifier func(toolName string) string
+	// OmitRawTools, with ToolClassifier, sends only the category summary and
+	// drops the raw tools_available list to save payload size.
+	OmitRawTools bool
+	// ToolsPrecedence decides how a tool list from WithToolsAvailable
+	// combines with the agent's tools_available argument. Default:
+	// ToolsHostWins.
+	ToolsPrecedence ToolsPrecedence
+	// StripANSI removes terminal escape sequences (colors, cursor movement,
+	// hyperlinks) that agents paste in with command output, noting each
+	// affected field in client_warnings.
+	StripANSI bool
+	// RedactionRules are applied, in order, to every agent-supplied string
+	// before anything is sent, logged, or spooled. Build them with
+	// regexp.MustCompile or load them with LoadRedactionRules.
+	RedactionRules []RedactionRule
+	// ClientTypes is the allowlist of client_type values, compared after
+	// lowercasing and hyphenating. Others are sent as "other" with the
+	// original in client_type_raw. Default: common MCP clients
+	// ("claude-desktop", "claude-code", "cursor", "vscode", ...).
+	ClientTypes []string
+	// ClientTypeAliases maps alternate spellings to an allowlisted value
+	// (e.g. "vs-code" → "vscode"), replacing the built-in aliases.
+	ClientTypeAliases map[string]string
+	// FieldLimits sets per-field byte budgets, keyed by JSON field name
+	// (e.g. "user_goal": 8000). Entries override the built-in defaults; zero
+	// or less disables the limit for that field. Over-limit values are
+	// truncated on a rune boundary and noted in client_warnings.
+	FieldLimits map[string]int
+	// OmitEmpty leaves optional fields out of the request body when they are
+	// empty instead of sending "" or null. Required fields are always sent.
+	OmitEmpty bool
+	// FieldNameMap renames JSON keys in the request body, e.g.
+	// {"gap_type": "category", "what_i_needed": "message"}, for collectors
+	// with their own schema. A map that would send two fields under one key
+	// fails every submission as an encoding error. Spool, unsent-log, and
+	// idempotency features read idempotency_key and client_timestamp back
+	// from the body, so leave those two names alone.
+	FieldNameMap map[string]string
+	// Marshal encodes the request body. Supply one to control field order or
+	// encoding. Default: JSON without HTML escaping, so text like "a < b &&
+	// c > d" arrives as written rather than as \u003c sequences.
+	Marshal func(any) ([]byte, error)
+	// Enrich, when set, can adjust each payload after it is built from the
+	// agent's arguments and before it is encoded, e.g. to add host context.
+	// If it returns an error, HookErrorPolicy decides whether the payload is
+	// sent without Enrich's changes or not at all. Enrich runs on a copy, so
+	// replace slice and map fields rather than modifying them in place.
+	Enrich func(ctx context.Context, f *Feedback) error
+	// HookErrorPolicy decides what a hook error (Enrich, Marshal) does to
+	// the submission. Either way the error is logged, naming the hook.
+	// Default: HookProceed.
+	HookErrorPolicy HookErrorPolicy
+	// Encoding sends requests in a compact binary format instead of JSON,
+	// e.g. CBOR from feedback_cbor.go. A sidecar that answers 415 or 422
+	// to it gets that request, and all later ones, as JSON. Default: JSON.
+	Encoding *Encoding
+	// DefaultTTL sets expires_at this far in the future on submissions
+	// where the agent gave neither expires_at nor ttl_seconds, so the sidecar
+	// can expire them. Zero means no expiry.
+	DefaultTTL time.Duration
+	// IncludeFieldSizes adds a field_sizes object with whitespace-delimited
+	// word counts of what_i_tried and user_goal, a cheap stand-in for token
+	// counts that gives analytics a verbosity measure.
+	IncludeFieldSizes bool
+	// ReportFieldLengths records the byte length of each agent-supplied
+	// text field, as sent and before FieldLimits truncation, in the
+	// field_bytes histogram of WriteMetrics, to show what limits would
+	// cost. Off by default.
+	ReportFieldLengths bool
+	// MaxPayloadBytes caps the encoded request body. Zero means no cap.
+	MaxPayloadBytes int
+	// PayloadLimitStrategy decides what happens when MaxPayloadBytes is
+	// exceeded. Default: PayloadReject.
+	PayloadLimitStrategy PayloadLimitStrategy
+	// MinInterval spaces every request to the sidecar at least this far
+	// apart, across all submissions in the process, to protect a fragile
+	// single-threaded sidecar. MinIntervalMode decides what happens to a
+	// request that arrives too soon.
+	MinInterval time.Duration
+	// MinIntervalMode selects how MinInterval is enforced. Default:
+	// ThrottleWait.
+	MinIntervalMode ThrottleMode
+	// OnUnsent is called with each payload that could not be delivered and
+	// was not spooled, e.g. to forward it to the host's own queue or logger.
+	OnUnsent func(UnsentLine)
+	// SilenceUnsentLog stops undeliverable feedback from being written to
+	// stderr, for hosts that alert on any stderr output.
+	//
+	// Warning: unless SpoolPath or OnUnsent is also configured, feedback that
+	// fails delivery is then lost without a trace.
+	SilenceUnsentLog bool
+	// UnsentLogPerMinute caps how many unsent-feedback lines reach stderr
+	// per minute, so a long outage can't flood the log pipeline. Lines over
+	// the cap are dropped from stderr (OnUnsent still sees them) and a
+	// summary line reports how many at the end of each minute. Zero means no
+	// cap.
+	UnsentLogPerMinute int
+	// SpoolEncodingErrors keeps feedback that can't be encoded (usually a
+	// custom Marshal or hook producing an unencodable value): it is
+	// re-encoded field by field, with any unencodable values as text, and
+	// spooled or logged like undeliverable feedback. Otherwise only a
+	// warning is logged.
+	SpoolEncodingErrors bool
+	// DebugLog logs each successful delivery at debug level, with the
+	// feedback ID, attempts, and latency, to confirm the happy path while
+	// onboarding. Off by default.
+	DebugLog bool
+	// Logger receives DebugLog output. Default: text to stderr.
+	Logger Logger
+	// LegacyUnsentLog restores the original "reason=… payload=…" format for
+	// unsent-feedback log lines instead of prefix + JSON.
+	LegacyUnsentLog bool
+	// ChunkUnsentLog, when set, splits unsent-feedback lines longer than
+	// this many bytes into base64 chunk lines that each fit, for log
+	// pipelines that break long lines (Docker splits at 16 KiB). Reassemble
+	// them with UnsentReassembler.
+	ChunkUnsentLog int
+	// SignUnsentLog adds an HMAC-SHA256 over each unsent-feedback line's
+	// time, reason, and payload, plus the key's ID, so log reviewers can
+	// detect tampering with VerifyUnsentLine.
+	SignUnsentLog *SigningKey
+	// Accept overrides the Accept header sent with each submission.
+	// Default: application/json, so the sidecar returns its JSON receipt.
+	Accept string
+	// SchemaVersion is sent as the X-Feedback-Schema header so the sidecar
+	// knows which field set to expect. Default: v1. If the sidecar lists the
+	// versions it accepts in X-Feedback-Schema-Supported and this isn't one
+	// of them, a warning is logged once per sidecar.
+	SchemaVersion string
+	// HTTPMethod is the method used to submit feedback. Default: POST to
+	// /api/feedback. PUT or PATCH instead target
+	// /api/feedback/{idempotency_key}, for collectors that create resources
+	// idempotently by key, and also accept 200 and 204 as success. Ignored
+	// when a custom Transport is set.
+	HTTPMethod string
+	// UseETag remembers the ETag from each accepted submission and sends it
+	// as If-None-Match when the same idempotency key is sent again (a
+	// re-invoked tool call, a spool replay), so a caching sidecar can answer
+	// 412 (or 304), which counts as delivered. Ignored with a custom Transport.
+	UseETag bool
+	// Jitter randomizes retry delays so many clients recovering from the
+	// same outage don't retry in lockstep. JitterStrategy picks the formula.
+	Jitter bool
+	// JitterStrategy selects the jitter formula when Jitter is set.
+	// Default: JitterFull.
+	JitterStrategy JitterStrategy
+	// SyncSLA, when set, caps each synchronous delivery at a single attempt
+	// within this budget. On a miss the payload is spooled (or logged) at
+	// once instead of retried, trading retries for predictable latency.
+	SyncSLA time.Duration
+	// AdaptiveTimeout, when set, replaces the fixed 5s request timeout with
+	// one derived from recent sidecar response times. Opt-in since it keeps
+	// per-endpoint state.
+	AdaptiveTimeout *AdaptiveTimeout
+	// EchoMode is a debugging aid for integration: instead of recording
+	// feedback, each submission is posted to the sidecar's echo endpoint and
+	// the result message summarizes what the sidecar received versus what
+	// was sent, plus any transforms the drop-in applied. Never enable it in
+	// production; nothing is stored.
+	EchoMode bool
+	// EchoPath is the echo endpoint used by EchoMode. Default: /api/echo.
+	EchoPath string
+	// CaptureResponse sets Result.Response to the sidecar's last response
+	// (status, headers, bounded body), for reading sidecar-specific fields.
+	CaptureResponse bool
+	// ConfirmRead, after the sidecar acknowledges a submission, fetches it
+	// back by the returned feedback ID and reports success only if that
+	// works. Doubles the round-trips. Ignored with a custom Transport.
+	ConfirmRead bool
+	// FollowupField names the string field in the sidecar's success response
+	// whose guidance, when present, is appended to the agent's message.
+	// Default: "followup".
+	FollowupField string
+	// RequestInterceptor is called with each outgoing feedback request,
+	// once per attempt, just before it is sent. Use it to capture requests
+	// in tests or add tracing; changes it makes are sent as-is.
+	RequestInterceptor func(*http.Request)
+	// Clock replaces the real clock, for tests. Default: time.Now/time.After.
+	Clock Clock
+	// Rand replaces the random source for retry jitter and weighted
+	// endpoint picks, for tests. It must return a value in [0, n).
+	// Default: math/rand/v2.
+	Rand func(n int64) int64
+	// Transport replaces HTTP delivery to the sidecar. SidecarURL, the API
+	// key, and health probing apply only to the default HTTP transport.
+	Transport Transport
+
+	shadow bool // set on the copy shadowSend delivers with
+}
+
+// WeightedURL is a sidecar URL and its share of traffic, relative to the
+// other WeightedEndpoints. Entries with a weight of zero or less get none.
+type WeightedURL struct {
+	URL    string
+	Weight int
+}
+
+// PayloadLimitStrategy selects how oversized submissions are handled.
+type PayloadLimitStrategy int
+
+const (
+	// PayloadReject refuses the submission and asks the agent to resend a
+	// more concise version.
+	PayloadReject PayloadLimitStrategy = iota
+	// PayloadDropLargest drops optional fields, largest first, until the
+	// payload fits; it rejects only if the required fields alone are too big.
+	PayloadDropLargest
+)
+
+// ThrottleMode selects how requests arriving within Options.MinInterval of
+// the previous one are handled.
+type ThrottleMode int
+
+const (
+	// ThrottleWait delays the request until its turn, bounded by the
+	// caller's context.
+	ThrottleWait ThrottleMode = iota
+	// ThrottleDefer doesn't send the request; the submission is spooled
+	// (or logged) as undeliverable for later replay.
+	ThrottleDefer
+)
+
+// QueuePolicy selects what the batch queue does when it is full.
+type QueuePolicy int
+
+const (
+	// DropOldest discards the longest-queued submission to make room.
+	DropOldest QueuePolicy = iota
+	// DropNewest discards the incoming submission.
+	DropNewest
+	// Block makes the incoming submission wait for room, until its context
+	// ends; it is then dropped.
+	Block
+)
+
+func (p QueuePolicy) String() string {
+	switch p {
+	case DropNewest:
+		return "drop_newest"
+	case Block:
+		return "block"
+	default:
+		return "drop_oldest"
+	}
+}
+
+func (o *Options) url() string {
+	if o != nil && o.EnvRouting[envName] != "" {
+		return o.EnvRouting[envName]
+	}
+	if o != nil && o.SidecarURL != "" {
+		return o.SidecarURL
+	}
+	return sidecarURL
+}
+
+func (o *Options) key() string {
+	if o != nil && o.APIKey != "" {
+		return o.APIKey
+	}
+	if o != nil && o.APIKeyFile != "" {
+		return readKeyFile(o.APIKeyFile)
+	}
+	if apiKey != "" {
+		return apiKey
+	}
+	if apiKeyFile != "" {
+		return readKeyFile(apiKeyFile)
+	}
+	return ""
+}
+
+// keyFile caches a secret read from disk along with the file's identity.
+type keyFile struct {
+	modTime time.Time
+	size    int64
+	key     string
+	warned  bool
+}
+
+var (
+	keyFilesMu sync.Mutex
+	keyFiles   = map[string]*keyFile{}
+)
+
+// readKeyFile returns the trimmed contents of the secret file at path. The
+// file is stat'ed on every use and re-read whenever its modification time or
+// size changes, so mounted secrets can rotate without a restart. A read
+// failure is warned about once and yields no key.
+func readKeyFile(path string) string {
+	info, statErr := os.Stat(path)
+
+	keyFilesMu.Lock()
+	defer keyFilesMu.Unlock()
+	kf, ok := keyFiles[path]
+	if !ok {
+		kf = &keyFile{}
+		keyFiles[path] = kf
+	}
+	if statErr == nil && kf.key != "" && info.ModTime().Equal(kf.modTime) && info.Size() == kf.size {
+		return kf.key
+	}
+
+	err := statErr
+	var b []byte
+	if err == nil {
+		b, err = os.ReadFile(path)
+	}
+	if err != nil {
+		if !kf.warned {
+			logWarning("cannot read API key file: %v", err)
+			kf.warned = true
+		}
+		kf.key = ""
+		return ""
+	}
+	kf.key = strings.TrimSpace(string(b))
+	kf.modTime, kf.size, kf.warned = info.ModTime(), info.Size(), false
+	return kf.key
+}
+
+func (o *Options) spoolPath() string {
+	if o != nil && o.SpoolPath != "" {
+		return o.SpoolPath
+	}
+	return spoolPath
+}
+
+// Routing paths reported in Result.Path and the path metrics. A weighted
+// route is reported as "weighted-N", N being its 1-based position in
+// WeightedEndpoints.
+const (
+	PathPrimary  = "primary"
+	PathProvided = "provided" // URLProvider
+	PathCustom   = "custom"   // Options.Transport
+	PathShadow   = "shadow"
+)
+
+// routeURL picks the sidecar for one submission, and names the path taken:
+// by weight from WeightedEndpoints when set, otherwise url().
+func (o *Options) routeURL() (string, string) {
+	if o == nil || len(o.WeightedEndpoints) == 0 {
+		return o.url(), PathPrimary
+	}
+	total := 0
+	for _, e := range o.WeightedEndpoints {
+		total += max(e.Weight, 0)
+	}
+	if total == 0 {
+		return o.url(), PathPrimary
+	}
+	n := int(o.randN(int64(total)))
+	for i, e := range o.WeightedEndpoints {
+		if n < max(e.Weight, 0) {
+			return e.URL, fmt.Sprintf("weighted-%d", i+1)
+		}
+		n -= max(e.Weight, 0)
+	}
+	return o.url(), PathPrimary
+}
+
+// transport returns the configured Transport, or the HTTP sidecar transport.
+// Each call routes independently, so retries through one transport stay on
+// the sidecar it picked.
+func (o *Options) transport(authKey string) Transport {
+	if o != nil && o.Transport != nil {
+		return o.Transport
+	}
+	base, path := o.routeURL()
+	t := &httpTransport{base: base, path: path, endpoint: base + "/api/feedback", auth: o.authenticator(authKey), accept: o.accept(), schema: o.schemaVersion(), method: "POST", timeout: o.timeout(), warn: o.warn}
+	if o != nil {
+		t.adaptive = o.AdaptiveTimeout
+		t.intercept = o.RequestInterceptor
+		t.encoding = o.Encoding
+		t.tls = o.TLSConfig
+		if o.HTTPMethod != "" {
+			t.method = strings.ToUpper(o.HTTPMethod)
+		}
+		if o.URLProvider != nil {
+			t.provided, t.path = o, PathProvided
+		}
+		t.etags = o.UseETag
+	}
+	return t
+}
+
+const defaultURLProviderTTL = time.Minute
+
+// maxProvidedURLs bounds the URLProvider cache, which holds one URL per
+// Options in use.
+const maxProvidedURLs = 64
+
+// providerCall is a URLProvider call in flight, shared by every submission
+// that needs a URL for the same Options meanwhile.
+type providerCall struct {
+	done chan struct{}
+	url  string
+	err  error
+}
+
+var (
+	providedURLs  = newLRU[*Options, string](maxProvidedURLs, 0)
+	providerMu    sync.Mutex // guards providerCalls
+	providerCalls = map[*Options]*providerCall{}
+)
+
+// providedEndpoint returns the cached URLProvider URL, fetching a new one if
+// there is none or it has expired. Concurrent callers for the same Options
+// share one provider call, and no lock is held while it runs.
+func (o *Options) providedEndpoint(ctx context.Context) (string, error) {
+	now := o.clock().Now()
+	providerMu.Lock()
+	if u, ok := providedURLs.Get(o, now); ok {
+		providerMu.Unlock()
+		return u, nil
+	}
+	call, running := providerCalls[o]
+	if !running {
+		call = &providerCall{done: make(chan struct{})}
+		providerCalls[o] = call
+	}
+	providerMu.Unlock()
+
+	if running {
+		select {
+		case <-call.done:
+			return call.url, call.err
+		case <-ctx.Done():
+			return "", ctx.Err()
+		}
+	}
+	call.url, call.err = o.URLProvider(ctx)
+	if call.err == nil {
+		ttl := o.URLProviderTTL
+		if ttl <= 0 {
+			ttl = defaultURLProviderTTL
+		}
+		providedURLs.Add(o, call.url, now, ttl)
+	}
+	providerMu.Lock()
+	delete(providerCalls, o)
+	providerMu.Unlock()
+	close(call.done)
+	return call.url, call.err
+}
+
+// forgetProvidedEndpoint drops the cached URLProvider URL.
+func (o *Options) forgetProvidedEndpoint() {
+	providedURLs.Remove(o)
+}
+
+func (o *Options) timeout() time.Duration {
+	if o != nil && o.Timeout > 0 {
+		return o.Timeout
+	}
+	return httpClient.Timeout
+}
+
+// httpClient returns the client for opts' Timeout and TLSConfig.
+func (o *Options) httpClient() *http.Client {
+	var tlsConf *tls.Config
+	if o != nil {
+		tlsConf = o.TLSConfig
+	}
+	return clientFor(o.timeout(), tlsConf)
+}
+
+func (o *Options) accept() string {
+	if o != nil && o.Accept != "" {
+		return o.Accept
+	}
+	return defaultAccept
+}
+
+func (o *Options) schemaVersion() string {
+	if o != nil && o.SchemaVersion != "" {
+		return o.SchemaVersion
+	}
+	return defaultSchema
+}
+
+func (o *Options) marshal() func(any) ([]byte, error) {
+	if o == nil || o.Marshal == nil {
+		return marshalJSON
+	}
+	return func(v any) ([]byte, error) {
+		body, err := o.Marshal(v)
+		if err == nil {
+			return body, nil
+		}
+		if err := o.hookFailed("marshal", err); err != nil {
+			return nil, err
+		}
+		return marshalJSON(v)
+	}
+}
+
+// HookError reports which Options hook failed. Result.Err holds one when a
+// hook failure stopped a submission.
+type HookError struct {
+	Hook string // "enrich", "marshal"
+	Err  error
+}
+
+func (e *HookError) Error() string { return e.Hook + " hook failed: " + e.Err.Error() }
+
+func (e *HookError) Unwrap() error { return e.Err }
+
+// HookErrorPolicy selects what happens when a hook returns an error.
+type HookErrorPolicy int
+
+const (
+	// HookProceed logs the error and carries on as if the hook weren't
+	// set: without the enrich hook's changes, with the default encoding.
+	HookProceed HookErrorPolicy = iota
+	// HookFail logs the error and abandons the submission.
+	HookFail
+)
+
+// warn is logWarning, except that a shadow send's warnings go to the debug
+// log, and only under DebugLog: the shadow sidecar is an experiment and
+// shouldn't add noise to the host's stderr.
+func (o *Options) warn(format string, args ...any) {
+	if o == nil || !o.shadow {
+		logWarning(format, args...)
+		return
+	}
+	if o.DebugLog {
+		o.logger().Debug("shadow send warning", "detail", fmt.Sprintf(format, args...))
+	}
+}
+
+// hookFailed logs a hook's error and returns it wrapped in a HookError if
+// the policy is HookFail, or nil to proceed without the hook.
+func (o *Options) hookFailed(hook string, err error) error {
+	herr := &HookError{Hook: hook, Err: err}
+	if o != nil && o.HookErrorPolicy == HookFail {
+		logWarning("%v", herr)
+		return herr
+	}
+	logWarning("%v; proceeding without it", herr)
+	return nil
+}
+
+// marshalJSON is json.Marshal without HTML escaping. Feedback is free text
+// about code, where <, >, and & are everywhere and never bound for HTML.
+func marshalJSON(v any) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buf.Bytes(), []byte("\n")), nil
+}
+
+func (o *Options) buildID() string {
+	if o != nil && o.BuildID != "" {
+		return o.BuildID
+	}
+	if o != nil && o.BuildIDEnv != "" {
+		return os.Getenv(o.BuildIDEnv)
+	}
+	if id := os.Getenv("BUILD_SHA"); id != "" {
+		return id
+	}
+	return os.Getenv("GIT_SHA")
+}
+
+var (
+	installIDMu sync.Mutex
+	installIDs  = map[string]string{} // by path; "" after a failure
+)
+
+// installID returns the install ID stored at path (or the default path),
+// creating it on first use. It returns "" if the ID can't be read or
+// written, warning once, rather than send an ID that won't persist.
+func installID(path string) string {
+	installIDMu.Lock()
+	defer installIDMu.Unlock()
+	if id, ok := installIDs[path]; ok {
+		return id
+	}
+	id, err := loadInstallID(path)
+	if err != nil {
+		logWarning("install_id unavailable: %v", err)
+	}
+	installIDs[path] = id
+	return id
+}
+
+func loadInstallID(path string) (string, error) {
+	if path == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return "", err
+		}
+		path = filepath.Join(dir, "patchworkmcp", "install_id")
+	}
+	if data, err := os.ReadFile(path); err == nil {
+		if id := strings.TrimSpace(string(data)); id != "" {
+			return id, nil
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return "", err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	id := newID()
+	if err := os.WriteFile(path, []byte(id+"\n"), 0o600); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+func (o *Options) clientTypes() []string {
+	if o != nil && o.ClientTypes != nil {
+		return o.ClientTypes
+	}
+	return defaultClientTypes
+}
+
+func (o *Options) clientAliases() map[string]string {
+	if o != nil && o.ClientTypeAliases != nil {
+		return o.ClientTypeAliases
+	}
+	return defaultClientAliases
+}
+
+func (o *Options) followupField() string {
+	if o != nil && o.FollowupField != "" {
+		return o.FollowupField
+	}
+	return "followup"
+}
+
+func (o *Options) maxPayloadBytes() int {
+	if o == nil {
+		return 0
+	}
+	return o.MaxPayloadBytes
+}
+
+func (o *Options) healthStaleness() time.Duration {
+	if o.HealthStaleness > 0 {
+		return o.HealthStaleness
+	}
+	return 2 * o.HealthProbeInterval
+}
+
+// Clock is the source of time for backoff sleeps, timestamps, and expiry.
+// Tests can substitute a fake to make retry and timestamp behavior
+// deterministic without real sleeps. Debounce windows, health probe ticks,
+// and HTTP timeouts still use real time.
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time                         { return time.Now() }
+func (realClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+
+func (o *Options) clock() Clock {
+	if o != nil && o.Clock != nil {
+		return o.Clock
+	}
+	return realClock{}
+}
+
+// randN returns a random value in [0, n) from Options.Rand, if set.
+func (o *Options) randN(n int64) int64 {
+	if o != nil && o.Rand != nil {
+		return o.Rand(n)
+	}
+	return mrand.N(n)
+}
+
+type apiKeyContextKey struct{}
+
+// WithAPIKey returns a context carrying a per-request API key. Multi-tenant
+// hosts can use it to authenticate each connection with its own credential
+// without building a separate handler per tenant.
+//
+// Precedence: context (WithAPIKey) > Options.APIKey > Options.APIKeyFile >
+// FEEDBACK_API_KEY > FEEDBACK_API_KEY_FILE.
+func WithAPIKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, apiKeyContextKey{}, key)
+}
+
+type requestIDContextKey struct{}
+
+// WithRequestID returns a context carrying the MCP (JSON-RPC) request ID of
+// the tool call, sent as mcp_request_id so feedback can be joined to host
+// request logs. mcp-go does not expose the ID to tool handlers, so hosts that
+// capture it elsewhere (e.g. in a server hook) can attach it here;
+// NewFeedbackHandler generates a random one otherwise.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDContextKey{}, id)
+}
+
+// newID returns a random 128-bit hex identifier.
+func newID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+const (
+	maxTags        = 32
+	maxTagKeyLen   = 64
+	maxTagValueLen = 256
+)
+
+type tagsContextKey struct{}
+
+// WithTags returns a context carrying per-call tags. They are merged over
+// Options.Tags, winning on conflicting keys.
+func WithTags(ctx context.Context, tags map[string]string) context.Context {
+	return context.WithValue(ctx, tagsContextKey{}, tags)
+}
+
+// mergeTags combines Options.Tags with per-call tags from ctx. Empty keys and
+// keys or values over the length bounds are skipped with a warning, as are
+// tags beyond maxTags. Returns nil when there are none.
+func mergeTags(ctx context.Context, opts *Options, warnings *[]string) map[string]string {
+	callTags, _ := ctx.Value(tagsContextKey{}).(map[string]string)
+	var static map[string]string
+	if opts != nil {
+		static = opts.Tags
+	}
+	if len(static) == 0 && len(callTags) == 0 {
+		return nil
+	}
+	merged := make(map[string]string, len(static)+len(callTags))
+	for _, src := range []map[string]string{static, callTags} {
+		for k, v := range src {
+			merged[k] = v
+		}
+	}
+	keys := make([]string, 0, len(merged))
+	for k := range merged {
+		keys = append(keys, k)
+	}
+	slices.Sort(keys) // deterministic choice of which tags survive the cap
+	tags := make(map[string]string, len(merged))
+	for _, k := range keys {
+		v := merged[k]
+		switch {
+		case k == "" || len(k) > maxTagKeyLen || len(v) > maxTagValueLen:
+			*warnings = append(*warnings, fmt.Sprintf("tags: skipped %.64q (empty key, or key/value too long)", k))
+		case len(tags) >= maxTags:
+			*warnings = append(*warnings, fmt.Sprintf("tags: skipped %q (more than %d tags)", k, maxTags))
+		default:
+			tags[k] = v
+		}
+	}
+	return tags
+}
+
+// Authenticator adds credentials to an outgoing sidecar request.
+type Authenticator func(*http.Request)
+
+// BearerAuth sends key as "Authorization: Bearer <key>" (the default scheme).
+func BearerAuth(key string) Authenticator {
+	return func(req *http.Request) {
+		req.Header.Set("Authorization", "Bearer "+key)
+	}
+}
+
+// BasicAuth sends HTTP Basic credentials.
+func BasicAuth(username, password string) Authenticator {
+	return func(req *http.Request) {
+		req.SetBasicAuth(username, password)
+	}
+}
+
+// HeaderAuth sends value in a custom header, e.g. HeaderAuth("X-API-Key", k).
+func HeaderAuth(name, value string) Authenticator {
+	return func(req *http.Request) {
+		req.Header.Set(name, value)
+	}
+}
+
+// authenticator returns Options.Authenticator, or Bearer auth with authKey
+// when one is set, or nil for no auth.
+func (o *Options) authenticator(authKey string) Authenticator {
+	if o != nil && o.Authenticator != nil {
+		return o.Authenticator
+	}
+	if authKey != "" {
+		return BearerAuth(authKey)
+	}
+	return nil
+}
+
+const (
+	maxRecentErrors   = 5
+	maxRecentErrorLen = 500
+)
+
+type recentErrorsContextKey struct{}
+
+// WithRecentErrors returns a context carrying the session's most recent
+// tool-call errors, newest last. Hosts that track failures can stash them
+// here so feedback explains why the agent got stuck, even if the model
+// doesn't summarize them in what_i_tried.
+func WithRecentErrors(ctx context.Context, errs []string) context.Context {
+	return context.WithValue(ctx, recentErrorsContextKey{}, errs)
+}
+
+// boundRecentErrors combines host-supplied errors from ctx with any the agent
+// sent, keeping the newest maxRecentErrors and truncating each to
+// maxRecentErrorLen bytes.
+func boundRecentErrors(ctx context.Context, fromArgs []string, warnings *[]string) []string {
+	hostErrs, _ := ctx.Value(recentErrorsContextKey{}).([]string)
+	var all []string
+	for _, e := range append(fromArgs, hostErrs...) {
+		if e = strings.TrimSpace(e); e != "" {
+			all = append(all, e)
+		}
+	}
+	if len(all) > maxRecentErrors {
+		*warnings = append(*warnings, fmt.Sprintf("recent_errors: kept newest %d of %d", maxRecentErrors, len(all)))
+		all = all[len(all)-maxRecentErrors:]
+	}
+	for i, e := range all {
+		if len(e) > maxRecentErrorLen {
+			all[i] = truncateRunes(e, maxRecentErrorLen)
+		}
+	}
+	return all
+}
+
+type idempotencyContextKey struct{}
+
+// WithIdempotencyKey returns a context carrying an explicit idempotency key
+// for the submission. Without one, a key is derived from the feedback content.
+func WithIdempotencyKey(ctx context.Context, key string) context.Context {
+	return context.WithValue(ctx, idempotencyContextKey{}, key)
+}
+
+type contextHashContextKey struct{}
+
+// WithContextHash returns a context carrying a host-computed SHA-256 (hex) of
+// the conversation context, sent as context_hash so the sidecar can group
+// feedback from the same situation without ever seeing the conversation. It
+// takes precedence over a context_hash argument.
+func WithContextHash(ctx context.Context, hash string) context.Context {
+	return context.WithValue(ctx, contextHashContextKey{}, hash)
+}
+
+// inFeedbackContextKey marks contexts derived while a submission is being
+// processed. Hooks, transports, and handlers called during delivery see the
+// mark, so a host that reports their failures through SubmitFeedback or
+// ReportMissingTool is refused instead of looping.
+type inFeedbackContextKey struct{}
+
+// ErrReentrant is Result.Err for feedback refused because it was filed
+// from inside another submission's processing.
+var ErrReentrant = errors.New("feedback filed while processing another submission")
+
+// InFeedback reports whether ctx comes from a feedback submission in
+// progress. SubmitFeedback, ReportMissingTool, and Stage return at once,
+// sending nothing, when it does.
+func InFeedback(ctx context.Context) bool {
+	v, _ := ctx.Value(inFeedbackContextKey{}).(bool)
+	return v
+}
+
+func reentrantResult() Result {
+	logWarning("feedback refused: %v", ErrReentrant)
+	return Result{Message: "Feedback not recorded: it was filed while another submission was being processed.", Err: ErrReentrant}
+}
+
+// contextHashPattern matches a hex-encoded SHA-256.
+var contextHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// contextHash reads the hash from ctx or the context_hash argument,
+// dropping it with a warning unless it is 64 hex digits.
+func contextHash(ctx context.Context, args map[string]any, warnings *[]string) string {
+	hash, ok := ctx.Value(contextHashContextKey{}).(string)
+	if !ok {
+		hash = getString(args, "context_hash", warnings)
+	}
+	hash = strings.ToLower(strings.TrimSpace(hash))
+	if hash != "" && !contextHashPattern.MatchString(hash) {
+		*warnings = append(*warnings, fmt.Sprintf("context_hash: dropped %.80q (not a hex SHA-256)", hash))
+		return ""
+	}
+	return hash
+}
+
+// resolveKey picks the API key for a submission, honoring WithAPIKey.
+func resolveKey(ctx context.Context, opts *Options) string {
+	if k, ok := ctx.Value(apiKeyContextKey{}).(string); ok && k != "" {
+		return k
+	}
+	return opts.key()
+}
+
+// Result is the structured outcome of a submission.
+type Result struct {
+	// Message is the text to hand back to the agent.
+	Message string
+	// Rejected means the submission was refused before sending and the
+	// agent should revise and resend it. Handlers report it as a tool error.
+	Rejected bool
+	// Delivered means the sidecar accepted the submission.
+	Delivered bool
+	// Spooled means delivery failed but the payload was written to the
+	// spool for ReplaySpool. Undelivered feedback that was not spooled only
+	// reached the unsent log (or OnUnsent) and may be lost.
+	Spooled bool
+	// Response is the sidecar's last HTTP response when
+	// Options.CaptureResponse is set; nil otherwise, or if none arrived.
+	Response *RawResponse
+	// ETag is the sidecar's ETag for the stored record, if it sent one.
+	ETag string
+	// Skipped means the submission was deliberately not sent to shed load
+	// (low priority while busy, or a full batch queue). It is not a failure
+	// and the agent shouldn't resend it.
+	Skipped bool
+	// Err is why the submission was abandoned before sending, if it was;
+	// errors.As finds a *HookError when a hook was to blame.
+	Err error
+	// Endpoint is the URL the last request went to, including a
+	// URLProvider's, with credentials redacted and any query string (such
+	// as a presigned signature) removed; empty with a custom Transport.
+	Endpoint string
+	// Path names the route taken: PathPrimary, "weighted-N", PathProvided,
+	// or PathCustom. Shadow sends are counted under PathShadow in
+	// WriteMetrics but never reported here.
+	Path string
+}
+
+// defaultSkippedMessage acknowledges skipped feedback without suggesting it
+// failed, so the agent doesn't re-file it and add to the load.
+const defaultSkippedMessage = "Thank you, noted. Similar feedback has already been captured, so there is no need to report this again."
+
+// skippedResult is the Result for a submission shed under load.
+func skippedResult(opts *Options) Result {
+	msg := defaultSkippedMessage
+	if opts != nil && opts.SkippedMessage != "" {
+		msg = opts.SkippedMessage
+	}
+	return Result{Message: msg, Skipped: true}
+}
+
+// RawResponse is a snapshot of a sidecar response for callers that need
+// sidecar-specific headers or fields. Body holds at most the first 64 KiB,
+// and credential headers are redacted.
+type RawResponse struct {
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// redactedHeaders may echo credentials back and are never exposed as-is.
+var redactedHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie", "X-Api-Key"}
+
+// SendFeedback posts feedback to the sidecar with retry logic.
+//
+// Retries up to maxRetries times on transient failures (connection errors,
+// 5xx, 429) with exponential backoff, dropping retries that wouldn't fit
+// before ctx's deadline. Uses a module-level http.Client for
+// connection pooling. Best-effort — returns a message regardless of outcome.
+// Pass nil for opts to use environment variable defaults.
+func SendFeedback(ctx context.Context, args map[string]any, serverName string, opts *Options) string {
+	return SubmitFeedback(ctx, args, serverName, opts).Message
+}
+
+// SubmitFeedback is SendFeedback with a structured Result.
+func SubmitFeedback(ctx context.Context, args map[string]any, serverName string, opts *Options) Result {
+	if InFeedback(ctx) {
+		return reentrantResult()
+	}
+	ctx = context.WithValue(ctx, inFeedbackContextKey{}, true)
+	sub, res := prepareFeedback(ctx, args, serverName, opts)
+	if sub == nil {
+		return res
+	}
+	res = sub.send(ctx)
+	if sub.payload.missingToolUnnamed() {
+		res.Message += " If you can name the tool you wished existed, include it as expected_tool next time."
+	}
+	if note := strings.TrimSpace(getString(args, "meta_note", new([]string))); note != "" {
+		submitMetaNote(ctx, note, &sub.payload, opts)
+	}
+	return res
+}
+
+// submitMetaNote files an agent's comment on the feedback tool itself as its
+// own gap_type=meta record, so it never mixes with feedback about the
+// server. It shares the original's session and client attribution.
+func submitMetaNote(ctx context.Context, note string, orig *Feedback, opts *Options) {
+	if key, ok := ctx.Value(idempotencyContextKey{}).(string); ok && key != "" {
+		ctx = WithIdempotencyKey(ctx, key+"-meta")
+	}
+	sub, _ := prepareFeedback(ctx, map[string]any{
+		"what_i_needed": note,
+		"what_i_tried":  "Used the " + ToolName + " tool.",
+		"gap_type":      "meta",
+		"session_id":    orig.SessionID,
+		"agent_model":   orig.AgentModel,
+		"client_type":   orig.ClientType,
+	}, orig.ServerName, opts)
+	if sub != nil {
+		sub.send(ctx)
+	}
+}
+
+// missingToolUnnamed reports whether p is missing_tool feedback that
+// doesn't say which tool was missing.
+func (p *Feedback) missingToolUnnamed() bool {
+	missing := p.GapType == "missing_tool" || slices.Contains(p.GapTypes, "missing_tool")
+	return missing && p.ExpectedTool == ""
+}
+
+// ReportMissingTool files missing_tool feedback on the host's behalf when
+// an agent calls a tool the server doesn't have, so the gap is captured even
+// if the model never reports it. Call it from the tool-dispatch error path;
+// it is tagged synthetic=missing_tool to tell it apart from agent reports.
+// Calls from inside another submission's processing are refused; see
+// InFeedback. Pass nil for opts to use environment variable defaults.
+func ReportMissingTool(ctx context.Context, toolName, serverName string, opts *Options) Result {
+	tags, _ := ctx.Value(tagsContextKey{}).(map[string]string)
+	tags = maps.Clone(tags)
+	if tags == nil {
+		tags = map[string]string{}
+	}
+	tags["synthetic"] = "missing_tool"
+	ctx = WithTags(ctx, tags)
+	ctx = context.WithValue(ctx, hostRecordContextKey{}, true)
+	return SubmitFeedback(ctx, map[string]any{
+		"what_i_needed": fmt.Sprintf("A tool named %q", toolName),
+		"what_i_tried":  fmt.Sprintf("Called %q, which this server does not provide.", toolName),
+		"gap_type":      "missing_tool",
+		"expected_tool": toolName,
+	}, serverName, opts)
+}
+
+// hostRecordContextKey marks records the host files itself (ReportMissingTool,
+// heartbeats), which are exempt from RequireSessionID. Unlike the synthetic
+// tag, callers can't set it.
+type hostRecordContextKey struct{}
+
+// submission is feedback that has been built and encoded, ready to send.
+type submission struct {
+	serverName string
+	payload    Feedback
+	body       []byte
+	linked     bool
+	authKey    string
+	opts       *Options
+}
+
+var (
+	processStart  = time.Now()
+	submissionSeq atomic.Int64
+)
+
+// prepareFeedback builds and encodes the payload. When the call ends before
+// delivery — a cached result, an encoding error, an oversized payload — it
+// returns a nil submission and the final Result.
+func prepareFeedback(ctx context.Context, args map[string]any, serverName string, opts *Options) (*submission, Result) {
+	payload, linked := buildPayload(ctx, args, serverName, opts)
+	host, _ := ctx.Value(hostRecordContextKey{}).(bool)
+	if opts != nil && opts.RequireSessionID && payload.SessionID == "" && !host {
+		return nil, Result{
+			Message:  "Feedback was not recorded: this server requires a session_id. Please resend it with the identifier of the current conversation or session.",
+			Rejected: true,
+		}
+	}
+	if opts != nil && opts.ResultCacheTTL > 0 && payload.Priority != priorityHigh {
+		if res, ok := resultCache.Get(payload.IdempotencyKey, opts.clock().Now()); ok {
+			return nil, res
+		}
+	}
+
+	if enriched, err := enrich(ctx, payload, opts); err != nil {
+		if err := opts.hookFailed("enrich", err); err != nil {
+			return nil, Result{Message: "Feedback noted (enrich hook error).", Err: err}
+		}
+	} else {
+		payload = enriched
+	}
+	if payload.SessionID != "" {
+		payload.SessionSeq = trackSession(payload.SessionID, opts)
+	}
+	if opts != nil && opts.ReportFieldLengths {
+		stats.recordFieldLengths(args, payload.textFields())
+	}
+	if opts != nil && opts.IncludeProcessStats {
+		payload.ProcessUptimeMS = time.Since(processStart).Milliseconds()
+		payload.SubmissionSeq = submissionSeq.Add(1)
+	}
+
+	body, err := encodePayload(&payload, opts)
+	if err != nil {
+		return nil, encodingFailed(&payload, err, opts)
+	}
+	if limit := opts.maxPayloadBytes(); limit > 0 && len(body) > limit {
+		if opts.PayloadLimitStrategy == PayloadDropLargest {
+			body, err = shrinkPayload(&payload, limit, opts)
+			if err != nil {
+				return nil, encodingFailed(&payload, err, opts)
+			}
+		}
+		if len(body) > limit {
+			return nil, Result{
+				Message: fmt.Sprintf("Feedback is too large to send (%d bytes, limit %d). "+
+					"Please resend a more concise version: shorten %s.", len(body), limit, payload.oversizedFields()),
+				Rejected: true,
+			}
+		}
+	}
+
+	return &submission{
+		serverName: serverName,
+		payload:    payload,
+		body:       body,
+		linked:     linked,
+		// Resolve the key now: debounced and staged deliveries run after
+		// ctx is gone.
+		authKey: resolveKey(ctx, opts),
+		opts:    opts,
+	}, Result{}
+}
+
+// ValidateArgs checks tool arguments against the rules SubmitFeedback
+// applies, without sending anything, so a host can have the agent fix them
+// first. It returns one message per problem: a missing required field
+// (including session_id under RequireSessionID), a value that would be
+// coerced, dropped, or truncated, or a payload over MaxPayloadBytes that
+// would be rejected. No messages means the arguments would be sent as
+// given. Pass nil for opts to use the defaults.
+func ValidateArgs(args map[string]any, opts *Options) []string {
+	var problems []string
+	for _, name := range NewFeedbackToolWithOptions(opts).InputSchema.Required {
+		// Read the field the way buildPayload does, so an array gap_type
+		// or a coerced number counts as present; the coercion itself is
+		// reported from ClientWarnings below.
+		var value string
+		if name == "gap_type" {
+			value, _ = parseGapTypes(args, new([]string))
+		} else {
+			value = getString(args, name, new([]string))
+		}
+		if strings.TrimSpace(value) == "" {
+			problems = append(problems, name+": required")
+		}
+	}
+	payload, _ := buildPayload(context.Background(), args, "", opts)
+	if enriched, err := enrich(context.Background(), payload, opts); err == nil {
+		payload = enriched
+	}
+	if opts != nil && opts.RequireSessionID && payload.SessionID == "" {
+		problems = append(problems, "session_id: required")
+	}
+	problems = append(problems, payload.ClientWarnings...)
+	if limit := opts.maxPayloadBytes(); limit > 0 && opts.PayloadLimitStrategy != PayloadDropLargest {
+		if body, err := encodePayload(&payload, opts); err == nil && len(body) > limit {
+			problems = append(problems, fmt.Sprintf("payload is %d bytes, over the %d-byte limit", len(body), limit))
+		}
+	}
+	return problems
+}
+
+// BuildPayload returns the payload SubmitFeedback would send for args,
+// without any network call, so tests can assert on field mapping, parsing,
+// normalization, and enrichment. Values carried on a context (WithTags and
+// the like) are not applied, Options.Enrich gets context.Background() and
+// is skipped if it fails, and session_seq, assigned at send time, is left
+// zero. Pass nil for opts to use environment variable defaults.
+func BuildPayload(args map[string]any, serverName string, opts *Options) Feedback {
+	payload, _ := buildPayload(context.Background(), args, serverName, opts)
+	if enriched, err := enrich(context.Background(), payload, opts); err == nil {
+		payload = enriched
+	}
+	return payload
+}
+
+// enrich returns p as adjusted by Options.Enrich, or p itself when there is
+// no Enrich hook.
+func enrich(ctx context.Context, p Feedback, opts *Options) (Feedback, error) {
+	if opts == nil || opts.Enrich == nil {
+		return p, nil
+	}
+	err := opts.Enrich(ctx, &p)
+	return p, err
+}
+
+// buildPayload turns tool arguments into the payload to send, applying every
+// normalization, limit, and enrichment along with the warnings they produce.
+// The bool reports whether it was reduced to a duplicate link record.
+func buildPayload(ctx context.Context, args map[string]any, serverName string, opts *Options) (Feedback, bool) {
+	tools := resolveTools(ctx, args, opts)
+
+	var warnings []string
+	payload := Feedback{
+		ServerName:  serverName,
+		WhatINeeded: getString(args, "what_i_needed", &warnings),
+		WhatITried:  getString(args, "what_i_tried", &warnings),
+		Suggestion:  getString(args, "suggestion", &warnings),
+		UserGoal:    getString(args, "user_goal", &warnings),
+		Resolution:  getString(args, "resolution", &warnings),
+		AgentModel:  getString(args, "agent_model", &warnings),
+		SessionID:   getString(args, "session_id", &warnings),
+		ClientType:  getString(args, "client_type", &warnings),
+		ToolsAvail:  tools,
+		References:  boundReferences(getList(args, "references"), &warnings),
+	}
+	payload.GapType, payload.GapTypes = parseGapTypes(args, &warnings)
+	payload.RecentErrors = boundRecentErrors(ctx, getList(args, "recent_errors"), &warnings)
+	payload.DuplicateOf = feedbackRef(args, "duplicate_of", &warnings)
+	payload.FollowsUpOn = feedbackRef(args, "follows_up_on", &warnings)
+	payload.ExpectedTool = expectedTool(args, &warnings)
+	payload.ContextHash = contextHash(ctx, args, &warnings)
+	payload.Priority = parsePriority(getString(args, "priority", &warnings), &warnings)
+	payload.ExpiresAt = parseExpiry(args, opts, &warnings)
+	payload.ClientWarnings = warnings
+	if opts != nil && opts.ToolClassifier != nil {
+		payload.ToolsByCategory = classifyTools(tools, opts.ToolClassifier)
+		if opts.OmitRawTools {
+			payload.ToolsAvail = nil
+		}
+	}
+	if id, ok := ctx.Value(requestIDContextKey{}).(string); ok {
+		payload.MCPRequestID = id
+	}
+	payload.BuildID = opts.buildID()
+	if opts != nil && opts.IncludeInstallID {
+		payload.InstallID = installID(opts.InstallIDPath)
+	}
+	payload.ClientTimestamp = opts.clock().Now().UTC().Format(time.RFC3339)
+	payload.Tags = mergeTags(ctx, opts, &payload.ClientWarnings)
+	if opts != nil && opts.StripANSI {
+		applyStripANSI(&payload)
+	}
+	if opts != nil && len(opts.RedactionRules) > 0 {
+		applyRedaction(&payload, opts.RedactionRules)
+	}
+	if opts != nil && opts.IncludeFieldSizes {
+		payload.FieldSizes = map[string]int{
+			"what_i_tried": len(strings.Fields(payload.WhatITried)),
+			"user_goal":    len(strings.Fields(payload.UserGoal)),
+		}
+	}
+	applyFieldLimits(&payload, opts)
+	if ct, known := normalizeClientType(payload.ClientType, opts); !known {
+		payload.ClientType, payload.ClientTypeRaw = ct, payload.ClientType
+	} else {
+		payload.ClientType = ct
+	}
+	if payload.GapType == "" {
+		payload.GapType = "other"
+	}
+	linked := payload.DuplicateOf != "" && opts != nil && opts.LinkDuplicates
+	if linked {
+		payload.asLinkRecord()
+	}
+	payload.IdempotencyKey, _ = ctx.Value(idempotencyContextKey{}).(string)
+	if payload.IdempotencyKey == "" {
+		payload.IdempotencyKey = payload.contentKey()
+	}
+	return payload, linked
+}
+
+// send delivers s, or hands it to the debounce or batch queue.
+func (s *submission) send(ctx context.Context) Result {
+	opts, body := s.opts, s.body
+	if opts != nil && opts.EchoMode {
+		return s.echo(ctx)
+	}
+
+	// Skip the retry dance entirely when the last probe saw the sidecar
+	// down. The probe pings the HTTP sidecar, so it says nothing about a
+	// custom Transport.
+	if opts != nil && opts.HealthProbeInterval > 0 && opts.Transport == nil && probeFor(opts).knownDown(opts.clock().Now(), opts.healthStaleness()) {
+		return unsentResult(handleUnsent(body, "sidecar_down", opts), "Server unreachable")
+	}
+
+	// High priority is never coalesced or held back; low priority is shed
+	// while background deliveries are backed up.
+	high := s.payload.Priority == priorityHigh
+	if s.payload.Priority == priorityLow && InflightCount() >= maxBackgroundSends {
+		return skippedResult(opts)
+	}
+	if opts != nil && opts.DebounceInterval > 0 && s.payload.SessionID != "" && !high {
+		debounce(s.serverName+"\x00"+s.payload.SessionID+"\x00"+s.payload.GapType, body, opts, s.authKey)
+		return Result{Message: "Thank you. Your feedback has been received and will be sent shortly."}
+	}
+	if opts != nil && opts.BatchSize > 0 && !high {
+		it := queuedFeedback{body: body, authKey: s.authKey, gapType: s.payload.GapType, priority: s.payload.Priority}
+		if !queueFor(opts).add(ctx, it) {
+			return skippedResult(opts)
+		}
+		return Result{Message: "Thank you. Your feedback has been received and will be sent shortly."}
+	}
+	retries := retriesFor(s.payload.Priority)
+	if opts != nil && opts.SyncSLA > 0 {
+		// One attempt inside a hard budget; a miss goes straight to the
+		// spool. Debounced and batched sends above keep their retries.
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, opts.SyncSLA)
+		defer cancel()
+		retries = 0
+	}
+	res := deliver(ctx, body, opts, s.authKey, retries)
+	if res.Delivered && s.linked {
+		res.Message = fmt.Sprintf("Thank you. This has been linked to existing feedback %s.", s.payload.DuplicateOf)
+	}
+	if res.Delivered && opts != nil && opts.ResultCacheTTL > 0 {
+		resultCache.Add(s.payload.IdempotencyKey, res, opts.clock().Now(), opts.ResultCacheTTL)
+	}
+	return res
+}
+
+// parseExpiry resolves the agent's expires_at or ttl_seconds, falling back
+// to Options.DefaultTTL, into an absolute UTC time. Values that are
+// malformed, in the past, or not positive are dropped with a warning.
+func parseExpiry(args map[string]any, opts *Options, warnings *[]string) string {
+	now := opts.clock().Now().UTC()
+	if raw, ok := args["expires_at"].(string); ok && raw != "" {
+		t, err := time.Parse(time.RFC3339, raw)
+		switch {
+		case err != nil:
+			*warnings = append(*warnings, fmt.Sprintf("expires_at: dropped %.40q (not RFC 3339)", raw))
+		case !t.After(now):
+			*warnings = append(*warnings, fmt.Sprintf("expires_at: dropped %s (in the past)", raw))
+		default:
+			return t.UTC().Format(time.RFC3339)
+		}
+	}
+	if v, ok := args["ttl_seconds"]; ok && v != nil {
+		var secs float64
+		var err error
+		switch v := v.(type) {
+		case float64:
+			secs = v
+		case string:
+			secs, err = strconv.ParseFloat(v, 64)
+		default:
+			err = fmt.Errorf("%T", v)
+		}
+		if err == nil && secs > 0 && secs < math.MaxInt64/float64(time.Second) {
+			return now.Add(time.Duration(secs * float64(time.Second))).Format(time.RFC3339)
+		}
+		*warnings = append(*warnings, fmt.Sprintf("ttl_seconds: dropped %.40v (not a positive number)", v))
+	}
+	if opts != nil && opts.DefaultTTL > 0 {
+		return now.Add(opts.DefaultTTL).Format(time.RFC3339)
+	}
+	return ""
+}
+
+const (
+	priorityLow    = "low"
+	priorityNormal = "normal"
+	priorityHigh   = "high"
+)
+
+// parsePriority normalizes the agent's priority, falling back to normal with
+// a warning for anything unrecognized.
+func parsePriority(raw string, warnings *[]string) string {
+	switch p := strings.ToLower(strings.TrimSpace(raw)); p {
+	case "":
+		return priorityNormal
+	case priorityLow, priorityNormal, priorityHigh:
+		return p
+	default:
+		*warnings = append(*warnings, fmt.Sprintf("priority: %.32q is not low, normal, or high; using normal", raw))
+		return priorityNormal
+	}
+}
+
+// retriesFor scales the retry budget with priority: low gets a single
+// best-effort attempt, high two extra retries.
+func retriesFor(priority string) int {
+	switch priority {
+	case priorityLow:
+		return 0
+	case priorityHigh:
+		return maxRetries + 2
+	default:
+		return maxRetries
+	}
+}
+
+const defaultEchoPath = "/api/echo"
+
+// echo posts s to the sidecar's echo endpoint, which stores nothing and
+// returns the body as it parsed it, and reports what arrived: fields that
+// were lost, changed, or added in transit, plus the transforms the drop-in
+// itself applied (its client warnings).
+func (s *submission) echo(ctx context.Context) Result {
+	opts := s.opts
+	path := opts.EchoPath
+	if path == "" {
+		path = defaultEchoPath
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", opts.url()+path, bytes.NewReader(s.body))
+	if err != nil {
+		return Result{Message: "Echo failed: " + err.Error()}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set(schemaHeader, opts.schemaVersion())
+	if auth := opts.authenticator(s.authKey); auth != nil {
+		auth(req)
+	}
+	resp, err := opts.httpClient().Do(req)
+	if err != nil {
+		return Result{Message: "Echo failed: " + err.Error()}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return Result{Message: fmt.Sprintf("Echo failed: sidecar returned %d from %s", resp.StatusCode, path)}
+	}
+	var sent, received map[string]json.RawMessage
+	json.Unmarshal(s.body, &sent)
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxReceiptBytes)).Decode(&received); err != nil {
+		return Result{Message: "Echo failed: response is not a JSON object"}
+	}
+
+	var diffs []string
+	for _, k := range slices.Sorted(maps.Keys(sent)) {
+		got, ok := received[k]
+		switch {
+		case !ok:
+			diffs = append(diffs, k+": not received")
+		case !jsonEqual(sent[k], got):
+			diffs = append(diffs, fmt.Sprintf("%s: sent %.80s, received %.80s", k, sent[k], got))
+		}
+	}
+	for _, k := range slices.Sorted(maps.Keys(received)) {
+		if _, ok := sent[k]; !ok {
+			diffs = append(diffs, k+": added by sidecar")
+		}
+	}
+
+	var b strings.Builder
+	fmt.Fprintf(&b, "Echo: sent %d bytes with %d fields; nothing was recorded.", len(s.body), len(sent))
+	if len(diffs) == 0 {
+		b.WriteString(" The sidecar received every field exactly as sent.")
+	} else {
+		b.WriteString(" Differences: " + strings.Join(diffs, "; ") + ".")
+	}
+	if len(s.payload.ClientWarnings) > 0 {
+		b.WriteString(" Client transforms: " + strings.Join(s.payload.ClientWarnings, "; ") + ".")
+	}
+	return Result{Message: b.String()}
+}
+
+// jsonEqual compares two JSON values semantically.
+func jsonEqual(a, b json.RawMessage) bool {
+	var x, y any
+	if json.Unmarshal(a, &x) != nil || json.Unmarshal(b, &y) != nil {
+		return bytes.Equal(a, b)
+	}
+	return reflect.DeepEqual(x, y)
+}
+
+// shrinkPayload drops the largest optional field, one at a time, until the
+// encoded payload fits within limit or nothing optional is left. Each drop is
+// recorded as a client warning. Returns the final encoding, which may still
+// exceed limit if the required fields alone are too large.
+func shrinkPayload(p *Feedback, limit int, opts *Options) ([]byte, error) {
+	for {
+		body, err := encodePayload(p, opts)
+		if err != nil || len(body) <= limit {
+			return body, err
+		}
+		var largest *sizedField
+		for _, f := range p.optionalFields() {
+			if f.size > 0 && (largest == nil || f.size > largest.size) {
+				largest = &f
+			}
+		}
+		if largest == nil {
+			return body, nil
+		}
+		largest.drop()
+		p.ClientWarnings = append(p.ClientWarnings, largest.name+": dropped to fit MaxPayloadBytes")
+	}
+}
+
+// sizedField is a variable-size payload field, its approximate encoded
+// size, and how to clear it.
+type sizedField struct {
+	name string
+	size int
+	drop func()
+}
+
+// optionalFields lists the fields PayloadDropLargest may drop. Sizes count
+// quotes and separators so lists and maps compare fairly with strings.
+func (p *Feedback) optionalFields() []sizedField {
+	fields := []sizedField{
+		{"tools_available", listSize(p.ToolsAvail), func() { p.ToolsAvail = nil }},
+		{"references", listSize(p.References), func() { p.References = nil }},
+		{"recent_errors", listSize(p.RecentErrors), func() { p.RecentErrors = nil }},
+		{"tags", mapSize(p.Tags), func() { p.Tags = nil }},
+		{"tools_by_category", mapSize(p.ToolsByCategory), func() { p.ToolsByCategory = nil }},
+	}
+	for _, f := range []namedField{
+		{"suggestion", &p.Suggestion},
+		{"user_goal", &p.UserGoal},
+		{"resolution", &p.Resolution},
+		{"agent_model", &p.AgentModel},
+		{"client_type", &p.ClientType},
+	} {
+		fields = append(fields, sizedField{f.name, len(*f.val), func() { *f.val = "" }})
+	}
+	return fields
+}
+
+// oversizedFields names up to three of the agent's fields to shorten when a
+// payload is still over MaxPayloadBytes, largest first. tools_by_category
+// and tags are left out since the agent doesn't write them directly.
+func (p *Feedback) oversizedFields() string {
+	fields := []sizedField{
+		{name: "what_i_needed", size: len(p.WhatINeeded)},
+		{name: "what_i_tried", size: len(p.WhatITried)},
+	}
+	for _, f := range p.optionalFields() {
+		if f.size > 0 && f.name != "tools_by_category" && f.name != "tags" {
+			fields = append(fields, f)
+		}
+	}
+	slices.SortStableFunc(fields, func(a, b sizedField) int { return b.size - a.size })
+	names := make([]string, 0, 3)
+	for _, f := range fields[:min(3, len(fields))] {
+		names = append(names, f.name)
+	}
+	return strings.Join(names, ", ")
+}
+
+func listSize(list []string) int {
+	n := 0
+	for _, s := range list {
+		n += len(s) + 3 // quotes and comma
+	}
+	return n
+}
+
+func mapSize[V any](m map[string]V) int {
+	n := 0
+	for k, v := range m {
+		n += len(k) + len(fmt.Sprint(v)) + 6 // quotes, colon, and comma
+	}
+	return n
+}
+
+// deliver posts an encoded payload to the sidecar, retrying transient
+// failures, and returns the message to hand back to the agent. Payloads that
+// cannot be delivered are spooled or logged via handleUnsent.
+func deliver(ctx context.Context, body []byte, opts *Options, authKey string, retries int) (res Result) {
+	if n := retriesWithin(ctx, retries, opts); n < retries {
+		if opts != nil && opts.DebugLog {
+			opts.logger().Debug("retries reduced", "reason", "deadline-too-short", "retries", n, "configured", retries)
+		}
+		retries = n
+	}
+	if opts != nil && opts.ShadowURL != "" {
+		shadowSend(body, opts)
+	}
+	start := opts.clock().Now()
+	out := post(ctx, body, opts, authKey, retries)
+	now := opts.clock().Now()
+	stats.record(out, now, now.Sub(start))
+	if out.ok() && opts != nil && opts.DebugLog {
+		opts.logger().Debug("feedback delivered",
+			"feedback_id", out.receipt.field("id"),
+			"attempts", out.attempts,
+			"latency_ms", now.Sub(start).Milliseconds())
+	}
+	defer func() { res.Endpoint, res.Path = out.endpoint, out.path }()
+	if opts != nil && opts.CaptureResponse {
+		defer func() { res.Response = out.receipt.raw() }()
+	}
+	if out.ok() && opts != nil && opts.ConfirmRead && opts.Transport == nil {
+		if err := confirmRead(ctx, out.receipt, opts, authKey); err != nil {
+			// The sidecar acknowledged but can't produce the record, so keep
+			// a copy. The idempotency key lets it drop the repeat if the
+			// first one did land.
+			spooled := handleUnsent(body, "unconfirmed:"+err.Error(), opts)
+			return unsentResult(spooled, "Server accepted the feedback but could not read it back")
+		}
+	}
+	if out.ok() {
+		msg := "Thank you. Your feedback has been recorded and will be used to improve this server's capabilities."
+		if followup := out.receipt.field(opts.followupField()); followup != "" {
+			msg += " The feedback server adds: " + followup
+		}
+		return Result{Message: msg, Delivered: true, ETag: out.receipt.header.Get("ETag")}
+	}
+	spooled := handleUnsent(body, out.reason(), opts)
+	if out.status != 0 {
+		return unsentResult(spooled, fmt.Sprintf("Server returned %d", out.status))
+	}
+	if host, ok := hostNotFound(out.err); ok {
+		return unsentResult(spooled, fmt.Sprintf("Sidecar host %q not found; check FEEDBACK_SIDECAR_URL", host))
+	}
+	if detail, ok := tlsFailure(out.err); ok {
+		return unsentResult(spooled, fmt.Sprintf("TLS error: %s (check FEEDBACK_SIDECAR_URL and the sidecar's certificate)", detail))
+	}
+	if errors.Is(out.err, errThrottled) {
+		return unsentResult(spooled, "Too soon after the previous submission")
+	}
+	return unsentResult(spooled, "Server unreachable")
+}
+
+// minAttemptTime is the least time a request is budgeted when deciding
+// whether a retry fits before the context deadline.
+const minAttemptTime = 250 * time.Millisecond
+
+// retriesWithin returns how many of retries fit before ctx's deadline,
+// counting each backoff and at least minAttemptTime (or the request
+// timeout, if shorter) per attempt. Without a deadline all of them fit.
+func retriesWithin(ctx context.Context, retries int, opts *Options) int {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return retries
+	}
+	remaining := time.Until(deadline)
+	attempt := min(minAttemptTime, opts.timeout())
+	need := attempt
+	for n := 0; n < retries; n++ {
+		need += backoffFor(n) + attempt
+		if need > remaining {
+			return n
+		}
+	}
+	return retries
+}
+
+// shadowSend mirrors body to Options.ShadowURL in the background, with the
+// primary's settings but none of its routing, credentials, spooling, or
+// throttling.
+func shadowSend(body []byte, opts *Options) {
+	shadow := *opts
+	shadow.SidecarURL, shadow.ShadowURL = opts.ShadowURL, ""
+	shadow.WeightedEndpoints, shadow.Transport, shadow.MinInterval = nil, nil, 0
+	shadow.URLProvider, shadow.EnvRouting = nil, nil
+	shadow.APIKey, shadow.APIKeyFile, shadow.Authenticator = opts.ShadowAPIKey, "", opts.ShadowAuthenticator
+	shadow.shadow = true
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		trackSend(func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 2*shadow.timeout()*(maxRetries+1))
+			defer cancel()
+			out := post(ctx, body, &shadow, shadow.APIKey, maxRetries)
+			stats.recordPath(PathShadow, out.ok())
+			if !out.ok() && opts.DebugLog {
+				opts.logger().Debug("shadow send failed", "reason", out.reason())
+			}
+		})
+	}()
+}
+
+// confirmRead fetches a just-acknowledged submission by ID from the sidecar
+// that accepted it and returns an error unless that sidecar serves it.
+func confirmRead(ctx context.Context, rcpt receipt, opts *Options, authKey string) error {
+	id := rcpt.field("id")
+	if !feedbackIDPattern.MatchString(id) {
+		return fmt.Errorf("no feedback ID in receipt")
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", rcpt.base+"/api/feedback/"+id, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "application/json")
+	if auth := opts.authenticator(authKey); auth != nil {
+		auth(req)
+	}
+	resp, err := opts.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("read-back of %s returned %d", id, resp.StatusCode)
+	}
+	return nil
+}
+
+// unsentResult describes an undelivered submission honestly: spooled
+// feedback will be retried, while logged feedback survives only in the logs.
+func unsentResult(spooled bool, detail string) Result {
+	if spooled {
+		return Result{
+			Message: "Feedback could not be delivered yet and was queued for later delivery. (" + detail + ")",
+			Spooled: true,
+		}
+	}
+	return Result{Message: "Feedback could not be delivered and was logged. (" + detail + ")"}
+}
+
+// hostNotFound reports whether err is a definitive DNS "no such host" answer,
+// as opposed to a temporary resolver failure, and returns the host name.
+func hostNotFound(err error) (string, bool) {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return dnsErr.Name, true
+	}
+	return "", false
+}
+
+// tlsFailure reports whether err is a TLS misconfiguration that retrying
+// won't fix — a non-TLS endpoint, or a certificate that fails verification
+// (expired, untrusted, wrong name) — and returns a short description.
+// Handshake timeouts are not matched and stay retryable.
+func tlsFailure(err error) (string, bool) {
+	var (
+		recordErr    tls.RecordHeaderError
+		verifyErr    *tls.CertificateVerificationError
+		authorityErr x509.UnknownAuthorityError
+		hostnameErr  x509.HostnameError
+		invalidErr   x509.CertificateInvalidError
+	)
+	switch {
+	case errors.As(err, &recordErr):
+		return "endpoint did not answer with TLS", true
+	case err != nil && strings.Contains(err.Error(), "server gave HTTP response to HTTPS client"):
+		// net/http replaces the RecordHeaderError with an unwrapped error.
+		return "endpoint speaks plain HTTP; use an http:// URL", true
+	case errors.As(err, &authorityErr):
+		return authorityErr.Error(), true
+	case errors.As(err, &hostnameErr):
+		return hostnameErr.Error(), true
+	case errors.As(err, &invalidErr):
+		return invalidErr.Error(), true
+	case errors.As(err, &verifyErr):
+		return verifyErr.Error(), true
+	}
+	return "", false
+}
+
+// brokenConnection reports whether err is the connection failing mid-request
+// (EPIPE or ECONNRESET), which can happen after the sidecar received the body.
+func brokenConnection(err error) bool {
+	return errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ECONNRESET)
+}
+
+// outcome is the final result of post's retry loop.
+type outcome struct {
+	delivered bool
+	receipt   receipt // last response, over a receipt-capable transport
+	status    int     // last status reported by the transport, 0 if none
+	err       error   // last delivery error
+	attempts  int     // requests made, including the last
+	endpoint  string  // redacted sidecar URL, empty for a custom transport
+	path      string  // routing path
+}
+
+func (o outcome) ok() bool { return o.delivered }
+
+// reason is the short failure tag used in unsent logs and the spool.
+func (o outcome) reason() string {
+	if o.status != 0 {
+		return fmt.Sprintf("status_%d", o.status)
+	}
+	if host, ok := hostNotFound(o.err); ok {
+		return "host_not_found:" + host
+	}
+	if detail, ok := tlsFailure(o.err); ok {
+		return "tls_error:" + detail
+	}
+	if brokenConnection(o.err) {
+		return fmt.Sprintf("connection_broken:%v", o.err)
+	}
+	if errors.Is(o.err, errThrottled) {
+		return "throttled"
+	}
+	return fmt.Sprintf("unreachable:%v", o.err)
+}
+
+// backoffFor returns the delay before retry number attempt+1. It depends only
+// on the attempt index within the current call, so every submission starts
+// from initialBackoff no matter how earlier submissions fared. Anything that
+// must persist across calls belongs in shared rate or health state, not here.
+func backoffFor(attempt int) time.Duration {
+	return time.Duration(float64(initialBackoff) * math.Pow(2, float64(attempt)))
+}
+
+// JitterStrategy selects how retry delays are randomized when Options.Jitter
+// is on, following "Exponential Backoff And Jitter" (AWS Architecture Blog).
+type JitterStrategy int
+
+const (
+	// JitterFull sleeps a random duration in [0, backoff). The default.
+	JitterFull JitterStrategy = iota
+	// JitterEqual sleeps backoff/2 plus a random duration in [0, backoff/2).
+	JitterEqual
+	// JitterDecorrelated sleeps a random duration in [initialBackoff,
+	// 3×previous sleep), capped at maxJitterBackoff.
+	JitterDecorrelated
+	// JitterNone uses the plain exponential backoff.
+	JitterNone
+)
+
+const maxJitterBackoff = 10 * time.Second
+
+// retryDelay returns the sleep before retry number attempt+1, given the
+// previous sleep in this call (zero before the first retry).
+func retryDelay(attempt int, prev time.Duration, opts *Options) time.Duration {
+	base := backoffFor(attempt)
+	if opts == nil || !opts.Jitter {
+		return base
+	}
+	switch opts.JitterStrategy {
+	case JitterFull:
+		return time.Duration(opts.randN(int64(base)))
+	case JitterEqual:
+		return base/2 + time.Duration(opts.randN(int64(base/2)))
+	case JitterDecorrelated:
+		prev = max(prev, initialBackoff)
+		return min(maxJitterBackoff, initialBackoff+time.Duration(opts.randN(int64(3*prev-initialBackoff))))
+	default:
+		return base
+	}
+}
+
+// post sends body through the configured transport, retrying up to retries
+// times on retryable failures with exponential backoff.
+func post(ctx context.Context, body []byte, opts *Options, authKey string, retries int) (out outcome) {
+	transport := opts.transport(authKey)
+	defer func() { out.endpoint, out.path = routeOf(transport, out.receipt) }()
+	var sleep time.Duration // previous delay, for decorrelated jitter
+
+	for attempt := 0; attempt <= retries; attempt++ {
+		if err := throttle(ctx, opts); err != nil {
+			return outcome{err: err}
+		}
+		var rcpt receipt
+		var err error
+		if rt, ok := transport.(receiptTransport); ok {
+			rcpt, err = rt.deliverWithReceipt(ctx, body)
+		} else {
+			err = transport.Deliver(ctx, body)
+		}
+		if err == nil {
+			return outcome{delivered: true, receipt: rcpt, attempts: attempt + 1}
+		}
+		out = outcome{err: err, receipt: rcpt, attempts: attempt + 1}
+		if brokenConnection(err) {
+			opts.warn("connection_broken on attempt %d: %v", attempt+1, err)
+		}
+		retryable := true // unclassified errors are treated as transient
+		var de *DeliveryError
+		if errors.As(err, &de) {
+			out.status = de.StatusCode
+			retryable = de.Retryable
+		}
+		if !retryable {
+			return out
+		}
+
+		if attempt < retries {
+			sleep = retryDelay(attempt, sleep, opts)
+			select {
+			case <-ctx.Done():
+				return out
+			case <-opts.clock().After(sleep):
+			}
+		}
+	}
+	return out
+}
+
+// routeOf reports where transport sent: the URL of the last request, from
+// rcpt, or else the transport's fixed endpoint, and the routing path.
+func routeOf(transport Transport, rcpt receipt) (string, string) {
+	t, ok := transport.(*httpTransport)
+	if !ok {
+		return "", PathCustom
+	}
+	endpoint := rcpt.endpoint
+	if endpoint == "" && t.provided == nil {
+		endpoint = t.endpoint
+	}
+	if u, err := url.Parse(endpoint); err == nil {
+		u.RawQuery, u.ForceQuery, u.Fragment = "", false, ""
+		endpoint = u.Redacted()
+	}
+	return endpoint, t.path
+}
+
+// handleUnsent spools a payload that could not be delivered, falling back to
+// the stderr log when no spool is configured or the spool write fails.
+// Reports whether the payload was spooled.
+func handleUnsent(body []byte, reason string, opts *Options) bool {
+	if path := opts.spoolPath(); path != "" {
+		err := appendSpool(path, SpoolEntry{Payload: body, SpooledAt: opts.clock().Now().UTC(), LastError: reason, Attempts: 1})
+		if err == nil {
+			if opts.SpoolMaxAge > 0 {
+				startSpoolSweeper(path, opts)
+			}
+			return true
+		}
+		reason = fmt.Sprintf("%s spool_error:%v", reason, err)
+	}
+	logUnsentPayload(body, reason, opts)
+	return false
+}
+
+// encodingFailed handles a payload that couldn't be encoded: it logs why,
+// naming any fields encoding/json also rejects, counts the failure in the
+// status resource, and with Options.SpoolEncodingErrors keeps a best-effort
+// encoding.
+func encodingFailed(p *Feedback, err error, opts *Options) Result {
+	body, bad := fallbackEncode(p)
+	reason := "encoding_error:" + err.Error()
+	if len(bad) > 0 {
+		reason += " fields:" + strings.Join(bad, ",")
+	}
+	logWarning("feedback not encoded: %s", reason)
+	stats.recordEncodingError(reason, opts.clock().Now())
+	if opts != nil && opts.SpoolEncodingErrors {
+		handleUnsent(body, reason, opts)
+	}
+	return Result{Message: "Feedback noted (encoding error).", Err: err}
+}
+
+// fallbackEncode encodes p one field at a time with encoding/json, so a
+// single bad value can't lose the rest. Values it can't encode are sent as
+// their %v text, and their field names (with Go type) are returned.
+func fallbackEncode(p *Feedback) ([]byte, []string) {
+	v := reflect.ValueOf(p).Elem()
+	fields := map[string]any{}
+	var bad []string
+	for i := range v.NumField() {
+		name, flags, _ := strings.Cut(v.Type().Field(i).Tag.Get("json"), ",")
+		if flags == "omitempty" && v.Field(i).IsZero() {
+			continue
+		}
+		val := v.Field(i).Interface()
+		if _, err := json.Marshal(val); err != nil {
+			bad = append(bad, fmt.Sprintf("%s(%T)", name, val))
+			val = fmt.Sprintf("%v", val)
+		}
+		fields[name] = val
+	}
+	body, _ := json.Marshal(fields)
+	return body, bad
+}
+
+// ── Staged Delivery ─────────────────────────────────────────────────────────
+
+// StagedFeedback is feedback built by Stage and held until the host decides
+// the interaction it belongs to has completed. Commit sends it; Discard, or
+// cancellation of the context passed to Stage, drops it unsent.
+type StagedFeedback struct {
+	mu   sync.Mutex
+	sub  *submission // nil once committed, discarded, or ended early
+	res  Result
+	stop func() bool
+}
+
+// Stage builds feedback exactly as SubmitFeedback would but holds it instead
+// of sending, for hosts that should only report gaps from turns that commit.
+// Pass nil for opts to use environment variable defaults.
+func Stage(ctx context.Context, args map[string]any, serverName string, opts *Options) *StagedFeedback {
+	if InFeedback(ctx) {
+		return &StagedFeedback{res: reentrantResult()}
+	}
+	sub, res := prepareFeedback(context.WithValue(ctx, inFeedbackContextKey{}, true), args, serverName, opts)
+	st := &StagedFeedback{sub: sub, res: res}
+	if sub != nil {
+		// Discard runs at once if ctx is already done, so hold the lock
+		// until stop is set.
+		st.mu.Lock()
+		st.stop = context.AfterFunc(ctx, st.Discard)
+		st.mu.Unlock()
+	}
+	return st
+}
+
+// Commit sends the staged feedback and returns the result. Committing again
+// returns the same result; committing after Discard sends nothing.
+func (s *StagedFeedback) Commit(ctx context.Context) Result {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sub == nil {
+		return s.res
+	}
+	if s.stop != nil {
+		s.stop()
+	}
+	s.res = s.sub.send(context.WithValue(ctx, inFeedbackContextKey{}, true))
+	s.sub = nil
+	return s.res
+}
+
+// Discard drops the staged feedback without sending it. It is a no-op once
+// the feedback has been committed.
+func (s *StagedFeedback) Discard() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.sub == nil {
+		return
+	}
+	if s.stop != nil {
+		s.stop()
+	}
+	s.sub = nil
+	s.res = Result{Message: "Feedback discarded; nothing was sent."}
+}
+
+// ── Transport ───────────────────────────────────────────────────────────────
+
+// Transport delivers one encoded payload to wherever feedback is collected.
+// SendFeedback owns retries, backoff, and spooling; a Transport makes a single
+// attempt per call. The default posts to the sidecar over HTTP. Set
+// Options.Transport to deliver over NATS, Kafka, etc. from a separate package.
+type Transport interface {
+	Deliver(ctx context.Context, body []byte) error
+}
+
+// HTTPTransport returns the default sidecar transport for opts, ignoring
+// opts.Transport, for code that forwards stored feedback to the sidecar,
+// such as the SQLite sink's Replay. Pass nil for opts to use environment
+// variable defaults.
+func HTTPTransport(opts *Options) Transport {
+	var o Options
+	if opts != nil {
+		o = *opts
+	}
+	o.Transport = nil
+	t := o.transport(o.key()).(*httpTransport)
+	if t.provided != nil {
+		t.provided = opts // share opts' URLProvider cache, not the copy's
+	}
+	return t
+}
+
+// DeliveryError is the error a Transport returns to tell the retry loop how
+// to proceed. Errors of any other type are treated as retryable.
+type DeliveryError struct {
+	// StatusCode is the HTTP (or HTTP-like) status, 0 if none was received.
+	StatusCode int
+	// Retryable reports whether another attempt might succeed.
+	Retryable bool
+	// Err is the underlying cause, if any.
+	Err error
+}
+
+func (e *DeliveryError) Error() string {
+	switch {
+	case e.Err != nil && e.StatusCode != 0:
+		return fmt.Sprintf("status %d: %v", e.StatusCode, e.Err)
+	case e.Err != nil:
+		return e.Err.Error()
+	default:
+		return fmt.Sprintf("status %d", e.StatusCode)
+	}
+}
+
+func (e *DeliveryError) Unwrap() error { return e.Err }
+
+// httpTransport posts to the sidecar's feedback endpoint.
+type httpTransport struct {
+	base      string // sidecar URL
+	path      string // routing path, for Result.Path and metrics
+	endpoint  string
+	auth      Authenticator
+	accept    string
+	schema    string   // X-Feedback-Schema version
+	method    string   // POST, or PUT/PATCH to endpoint/{idempotency key}
+	provided  *Options // set when the endpoint comes from its URLProvider
+	etags     bool     // send If-None-Match from etagCache
+	encoding  *Encoding
+	timeout   time.Duration
+	tls       *tls.Config
+	adaptive  *AdaptiveTimeout
+	intercept func(*http.Request)
+	warn      func(format string, args ...any) // Options.warn
+}
+
+// Encoding is an alternative wire format for the default HTTP transport
+// (see feedback_cbor.go). Payloads stay JSON everywhere else — spool, unsent
+// log, size limits — and are re-encoded only as each request is sent.
+type Encoding struct {
+	// ContentType is sent as the request's Content-Type.
+	ContentType string
+	// Marshal encodes the payload, decoded from JSON into generic values.
+	Marshal func(any) ([]byte, error)
+}
+
+// encode converts a JSON body to e's wire format.
+func (e *Encoding) encode(body []byte) ([]byte, error) {
+	var v any
+	if err := json.Unmarshal(body, &v); err != nil {
+		return nil, err
+	}
+	return e.Marshal(v)
+}
+
+// refusedEncodings records sidecars that rejected an Encoding, keyed by
+// base URL and content type.
+var refusedEncodings sync.Map
+
+func encodingRefused(base string, e *Encoding) bool {
+	_, refused := refusedEncodings.Load(base + " " + e.ContentType)
+	return refused
+}
+
+func refuseEncoding(base string, e *Encoding, warn func(string, ...any)) {
+	if _, seen := refusedEncodings.LoadOrStore(base+" "+e.ContentType, true); !seen {
+		warn("sidecar does not accept %s; sending JSON instead", e.ContentType)
+	}
+}
+
+func (t *httpTransport) Deliver(ctx context.Context, body []byte) error {
+	_, err := t.deliverWithReceipt(ctx, body)
+	return err
+}
+
+// idempotencyKeyOf reads the idempotency key back out of an encoded payload,
+// so spooled and replayed submissions keep their original key.
+func idempotencyKeyOf(body []byte) string {
+	var p struct {
+		Key string `json:"idempotency_key"`
+	}
+	json.Unmarshal(body, &p)
+	return p.Key
+}
+
+// maxReceiptBytes bounds how much of a success response is read.
+const maxReceiptBytes = 64 << 10
+
+// receipt is what the sidecar sent back for an accepted submission.
+type receipt struct {
+	status   int
+	header   http.Header
+	body     []byte // response body, at most maxReceiptBytes
+	base     string // URL of the sidecar that answered
+	endpoint string // URL the request went to, set even if none answered
+}
+
+// raw snapshots the response for Result.Response, or returns nil if there
+// was none.
+func (r receipt) raw() *RawResponse {
+	if r.status == 0 {
+		return nil
+	}
+	h := r.header.Clone()
+	for _, name := range redactedHeaders {
+		if h.Get(name) != "" {
+			h.Set(name, "[redacted]")
+		}
+	}
+	return &RawResponse{StatusCode: r.status, Header: h, Body: r.body}
+}
+
+// field returns a top-level string field from a JSON receipt body, or "".
+func (r receipt) field(name string) string {
+	var obj map[string]any
+	if json.Unmarshal(r.body, &obj) != nil {
+		return ""
+	}
+	s, _ := obj[name].(string)
+	return s
+}
+
+// etagCache holds the ETag of each accepted submission by idempotency key,
+// for Options.UseETag.
+var etagCache = newLRU[string, string](maxCachedResults, 24*time.Hour)
+
+// receiptTransport is implemented by transports that can report the
+// sidecar's acknowledgement, not just success or failure.
+type receiptTransport interface {
+	deliverWithReceipt(ctx context.Context, body []byte) (receipt, error)
+}
+
+func (t *httpTransport) deliverWithReceipt(ctx context.Context, body []byte) (receipt, error) {
+	wire, contentType := body, "application/json"
+	encoded := t.encoding != nil && !encodingRefused(t.base, t.encoding)
+	if encoded {
+		var err error
+		if wire, err = t.encoding.encode(body); err != nil {
+			return receipt{}, &DeliveryError{Err: fmt.Errorf("encoding as %s: %w", t.encoding.ContentType, err)}
+		}
+		contentType = t.encoding.ContentType
+	}
+	key := idempotencyKeyOf(body)
+	endpoint := t.endpoint
+	if t.provided != nil {
+		var err error
+		if endpoint, err = t.provided.providedEndpoint(ctx); err != nil {
+			return receipt{}, &DeliveryError{Err: fmt.Errorf("URLProvider: %w", err), Retryable: true}
+		}
+	} else if t.method != "POST" {
+		if key == "" {
+			return receipt{}, &DeliveryError{Err: fmt.Errorf("%s needs an idempotency key for the resource path", t.method)}
+		}
+		endpoint += "/" + url.PathEscape(key)
+	}
+	req, err := http.NewRequestWithContext(ctx, t.method, endpoint, bytes.NewReader(wire))
+	if err != nil {
+		return receipt{}, &DeliveryError{Err: err}
+	}
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", t.accept)
+	req.Header.Set(schemaHeader, t.schema)
+	conditional := false // If-None-Match sent
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+		if tag, ok := etagCache.Get(key, time.Now()); t.etags && ok {
+			req.Header.Set("If-None-Match", tag)
+			conditional = true
+		}
+	}
+	if t.auth != nil {
+		t.auth(req)
+	}
+
+	client := clientFor(t.timeout, t.tls)
+	var latency *latencyTracker
+	if t.adaptive != nil {
+		latency = latencyFor(t.endpoint)
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, latency.timeout(t.adaptive))
+		defer cancel()
+		req = req.WithContext(ctx)
+		client = clientFor(0, t.tls)
+	}
+	if t.intercept != nil {
+		// The request and its body reader are rebuilt on every attempt, so
+		// an interceptor that reads or replaces the body can't break retries.
+		t.intercept(req)
+	}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		// A misconfigured hostname will not start resolving on retry, but
+		// resolver blips during container or mesh startup often clear.
+		_, permanent := hostNotFound(err)
+		if _, bad := tlsFailure(err); bad {
+			permanent = true
+		}
+		if brokenConnection(err) && key == "" {
+			// The sidecar may have read the whole body before the link
+			// dropped; without a key to dedupe on, a retry could record it
+			// twice.
+			permanent = true
+		}
+		return receipt{endpoint: endpoint}, &DeliveryError{Err: err, Retryable: !permanent}
+	}
+	rcpt := receipt{status: resp.StatusCode, header: resp.Header, base: t.base, endpoint: endpoint}
+	rcpt.body, _ = io.ReadAll(io.LimitReader(resp.Body, maxReceiptBytes))
+	// Drain body so the connection can be reused.
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if latency != nil {
+		latency.record(time.Since(start))
+	}
+	checkSchemaSupported(t.base, t.schema, resp.Header, t.warn)
+	if encoded && (resp.StatusCode == http.StatusUnsupportedMediaType || resp.StatusCode == http.StatusUnprocessableEntity) {
+		// The sidecar can't read the encoding; resend this one, and every
+		// later one to this sidecar, as JSON.
+		refuseEncoding(t.base, t.encoding, t.warn)
+		return t.deliverWithReceipt(ctx, body)
+	}
+
+	lenient := t.method != "POST" || t.provided != nil
+	if resp.StatusCode == 201 || lenient && (resp.StatusCode == 200 || resp.StatusCode == 204) {
+		if tag := resp.Header.Get("ETag"); tag != "" && key != "" && t.etags {
+			etagCache.Add(key, tag, time.Now(), 0)
+		}
+		return rcpt, nil
+	}
+	if conditional && (resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPreconditionFailed) {
+		// The sidecar already has this submission. RFC 9110 answers a
+		// failed If-None-Match on POST or PUT with 412, but some servers
+		// send 304 regardless.
+		return rcpt, nil
+	}
+	retryable := isRetryableStatus(resp.StatusCode)
+	if resp.StatusCode == http.StatusForbidden && t.provided != nil {
+		// Most likely the provided URL expired early; fetch a fresh one.
+		t.provided.forgetProvidedEndpoint()
+		retryable = true
+	}
+	return rcpt, &DeliveryError{StatusCode: resp.StatusCode, Retryable: retryable}
+}
+
+const (
+	schemaHeader          = "X-Feedback-Schema"
+	schemaSupportedHeader = "X-Feedback-Schema-Supported"
+)
+
+// schemaWarned records sidecar+version pairs already warned about.
+var schemaWarned sync.Map
+
+// checkSchemaSupported warns, once per sidecar, if the sidecar advertises
+// the schema versions it accepts and ours isn't among them. Sidecars that
+// don't send the header are assumed to accept anything.
+func checkSchemaSupported(base, version string, h http.Header, warn func(string, ...any)) {
+	supported := h.Get(schemaSupportedHeader)
+	if supported == "" {
+		return
+	}
+	for v := range strings.SplitSeq(supported, ",") {
+		if strings.TrimSpace(v) == version {
+			return
+		}
+	}
+	if _, seen := schemaWarned.LoadOrStore(base+"\x00"+version, true); !seen {
+		warn("sidecar supports feedback schema %s, not %s", supported, version)
+	}
+}
+
+// ── Adaptive Timeout ────────────────────────────────────────────────────────
+
+// AdaptiveTimeout sizes each request's timeout from the sidecar's recent
+// response times: p95 of the last few dozen responses plus Margin, clamped to
+// [Floor, Ceiling]. Until enough samples exist, Ceiling is used.
+type AdaptiveTimeout struct {
+	Floor   time.Duration // default 500ms
+	Ceiling time.Duration // default 30s
+	Margin  time.Duration // default 250ms
+}
+
+const (
+	latencyWindow     = 64 // samples kept per endpoint
+	latencyMinSamples = 5  // below this, fall back to Ceiling
+)
+
+// latencyTracker is a ring buffer of recent response times for one endpoint.
+type latencyTracker struct {
+	mu      sync.Mutex
+	samples [latencyWindow]time.Duration
+	n       int // total recorded; the ring holds min(n, latencyWindow)
+}
+
+var (
+	latencyMu sync.Mutex
+	latencies = map[string]*latencyTracker{}
+)
+
+func latencyFor(endpoint string) *latencyTracker {
+	latencyMu.Lock()
+	defer latencyMu.Unlock()
+	t, ok := latencies[endpoint]
+	if !ok {
+		t = &latencyTracker{}
+		latencies[endpoint] = t
+	}
+	return t
+}
+
+func (t *latencyTracker) record(d time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.samples[t.n%latencyWindow] = d
+	t.n++
+}
+
+func (t *latencyTracker) timeout(cfg *AdaptiveTimeout) time.Duration {
+	floor, ceiling, margin := cfg.Floor, cfg.Ceiling, cfg.Margin
+	if floor <= 0 {
+		floor = 500 * time.Millisecond
+	}
+	if ceiling <= 0 {
+		ceiling = 30 * time.Second
+	}
+	if margin <= 0 {
+		margin = 250 * time.Millisecond
+	}
+
+	t.mu.Lock()
+	count := min(t.n, latencyWindow)
+	sorted := make([]time.Duration, count)
+	copy(sorted, t.samples[:count])
+	t.mu.Unlock()
+	if count < latencyMinSamples {
+		return ceiling
+	}
+
+	slices.Sort(sorted)
+	p95 := sorted[(count-1)*95/100]
+	return max(floor, min(ceiling, p95+margin))
+}
+
+// ── Bounded LRU ─────────────────────────────────────────────────────────────
+
+// lruCache is a concurrency-safe map bounded by entry count, evicting the
+// least recently used entry when full and dropping entries past their
+// expiry. Per-session and per-key state lives in one of these so that state
+// for sessions that come and go can't grow without limit.
+type lruCache[K comparable, V any] struct {
+	mu    sync.Mutex
+	max   int
+	ttl   time.Duration // default lifetime; zero means entries never expire
+	order *list.List    // of *lruEntry[K, V], most recently used at the front
+	items map[K]*list.Element
+}
+
+type lruEntry[K comparable, V any] struct {
+	key     K
+	val     V
+	expires time.Time // zero means never
+}
+
+func newLRU[K comparable, V any](maxEntries int, ttl time.Duration) *lruCache[K, V] {
+	return &lruCache[K, V]{max: maxEntries, ttl: ttl, order: list.New(), items: map[K]*list.Element{}}
+}
+
+// Get returns the live value for key and marks it recently used.
+func (c *lruCache[K, V]) Get(key K, now time.Time) (V, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.getLocked(key, now)
+}
+
+func (c *lruCache[K, V]) getLocked(key K, now time.Time) (V, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		var zero V
+		return zero, false
+	}
+	e := el.Value.(*lruEntry[K, V])
+	if !e.expires.IsZero() && now.After(e.expires) {
+		c.removeLocked(el)
+		var zero V
+		return zero, false
+	}
+	c.order.MoveToFront(el)
+	return e.val, true
+}
+
+// Add stores val under key. A positive ttl overrides the cache default.
+func (c *lruCache[K, V]) Add(key K, val V, now time.Time, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.addLocked(key, val, now, ttl)
+}
+
+func (c *lruCache[K, V]) addLocked(key K, val V, now time.Time, ttl time.Duration) {
+	if ttl <= 0 {
+		ttl = c.ttl
+	}
+	var expires time.Time
+	if ttl > 0 {
+		expires = now.Add(ttl)
+	}
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*lruEntry[K, V])
+		e.val, e.expires = val, expires
+		c.order.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.order.PushFront(&lruEntry[K, V]{key: key, val: val, expires: expires})
+	c.evictLocked(now)
+}
+
+// Remove deletes key if present.
+func (c *lruCache[K, V]) Remove(key K) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeLocked(el)
+	}
+}
+
+// Resize changes the entry bound, evicting least recently used entries if
+// the cache is now over it.
+func (c *lruCache[K, V]) Resize(maxEntries int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.max == maxEntries {
+		return
+	}
+	c.max = maxEntries
+	for c.max > 0 && len(c.items) > c.max {
+		c.removeLocked(c.order.Back())
+	}
+}
+
+// Len returns the number of entries, including any not yet swept as expired.
+func (c *lruCache[K, V]) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return len(c.items)
+}
+
+// evictLocked drops expired entries from the cold end, then least recently
+// used entries until the cache is within max.
+func (c *lruCache[K, V]) evictLocked(now time.Time) {
+	for el := c.order.Back(); el != nil; {
+		prev := el.Prev()
+		if e := el.Value.(*lruEntry[K, V]); !e.expires.IsZero() && now.After(e.expires) {
+			c.removeLocked(el)
+		}
+		el = prev
+	}
+	for c.max > 0 && len(c.items) > c.max {
+		c.removeLocked(c.order.Back())
+	}
+}
+
+func (c *lruCache[K, V]) removeLocked(el *list.Element) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*lruEntry[K, V]).key)
+}
+
+// ── Sessions ────────────────────────────────────────────────────────────────
+
+// Per-session counters live in one shared LRU so a busy multi-user server
+// can't grow it without bound. Evicting a session forgets its counters.
+
+const defaultMaxTrackedSessions = 1024
+
+type sessionState struct {
+	submissions int
+}
+
+var sessions = newLRU[string, *sessionState](defaultMaxTrackedSessions, 0)
+
+// trackSession records a submission for id and returns its sequence number
+// within the session.
+func trackSession(id string, opts *Options) int {
+	if opts != nil && opts.MaxTrackedSessions > 0 {
+		sessions.Resize(opts.MaxTrackedSessions)
+	}
+	now := opts.clock().Now()
+	sessions.mu.Lock()
+	defer sessions.mu.Unlock()
+	st, ok := sessions.getLocked(id, now)
+	if !ok {
+		st = &sessionState{}
+		sessions.addLocked(id, st, now, 0)
+	}
+	st.submissions++
+	return st.submissions
+}
+
+// TrackedSessions reports how many distinct sessions currently have state,
+// for diagnostics.
+func TrackedSessions() int {
+	return sessions.Len()
+}
+
+// ── Result Cache ────────────────────────────────────────────────────────────
+
+// Agents sometimes re-invoke the tool with identical arguments (e.g. after a
+// client-side timeout). With Options.ResultCacheTTL set, a delivered result is
+// remembered by idempotency key and returned for repeats without another
+// round-trip.
+
+const maxCachedResults = 256
+
+var resultCache = newLRU[string, Result](maxCachedResults, 0)
+
+// CachedResults reports how many results the idempotency cache holds, for
+// diagnostics.
+func CachedResults() int {
+	return resultCache.Len()
+}
+
+// ── Background Sends ────────────────────────────────────────────────────────
+
+// Debounced and batched feedback is delivered off the tool call. Every such
+// goroutine is counted in background so Close can wait for it, and each
+// delivery takes one of maxBackgroundSends slots so a backlog can't open
+// unbounded connections to the sidecar.
+
+const maxBackgroundSends = 8
+
+var (
+	background sync.WaitGroup // goroutines running outside a tool call
+	sendSlots  = make(chan struct{}, maxBackgroundSends)
+	inflight   atomic.Int64
+)
+
+// InflightCount reports how many background deliveries are running or
+// waiting for a send slot, for leak and backlog diagnostics.
+func InflightCount() int {
+	return int(inflight.Load())
+}
+
+// trackSend runs a background delivery once a send slot is free, counting
+// it in InflightCount from the moment it is requested. A panic in send,
+// such as from an OnUnsent hook, is logged rather than crashing the host.
+func trackSend(send func()) {
+	inflight.Add(1)
+	defer inflight.Add(-1)
+	sendSlots <- struct{}{}
+	defer func() { <-sendSlots }()
+	defer recoverBackground("background delivery")
+	send()
+}
+
+// recoverBackground, deferred in a background goroutine, logs a panic with
+// its stack instead of letting it take down the host.
+func recoverBackground(what string) {
+	if r := recover(); r != nil {
+		logWarning("%s panicked: %v\n%s", what, r, debug.Stack())
+	}
+}
+
+// ── Throttle ────────────────────────────────────────────────────────────────
+
+// With Options.MinInterval set, every request to the sidecar reserves the
+// next free slot on one process-wide gate, so requests go out at least
+// MinInterval apart however many goroutines are sending.
+
+var errThrottled = errors.New("throttled: within MinInterval of the previous request")
+
+var sendGate struct {
+	mu   sync.Mutex
+	next time.Time // earliest time the next request may go out
+}
+
+// throttle waits for, or with ThrottleDefer refuses, the next send slot.
+func throttle(ctx context.Context, opts *Options) error {
+	if opts == nil || opts.MinInterval <= 0 {
+		return nil
+	}
+	now := opts.clock().Now()
+	sendGate.mu.Lock()
+	slot := now
+	if sendGate.next.After(now) {
+		if opts.MinIntervalMode == ThrottleDefer {
+			sendGate.mu.Unlock()
+			return errThrottled
+		}
+		slot = sendGate.next
+	}
+	sendGate.next = slot.Add(opts.MinInterval)
+	sendGate.mu.Unlock()
+
+	if wait := slot.Sub(now); wait > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-opts.clock().After(wait):
+		}
+	}
+	return nil
+}
+
+// ── Debounce ────────────────────────────────────────────────────────────────
+
+// Chatty agents often file several refinements of the same report within a
+// few seconds. With Options.DebounceInterval set, the first submission for a
+// session+gap_type opens a window; later submissions in that window replace
+// the held payload, and only the most recent one is sent when it closes.
+
+type pendingFeedback struct {
+	body    []byte
+	opts    *Options
+	authKey string
+	timer   *time.Timer
+}
+
+var (
+	debounceMu sync.Mutex
+	pending    = map[string]*pendingFeedback{}
+)
+
+func debounce(key string, body []byte, opts *Options, authKey string) {
+	debounceMu.Lock()
+	defer debounceMu.Unlock()
+	if p, ok := pending[key]; ok {
+		p.body, p.opts, p.authKey = body, opts, authKey
+		return
+	}
+	p := &pendingFeedback{body: body, opts: opts, authKey: authKey}
+	background.Add(1)
+	p.timer = time.AfterFunc(opts.DebounceInterval, func() {
+		defer background.Done()
+		if p := takePending(key); p != nil {
+			trackSend(func() { deliver(context.Background(), p.body, p.opts, p.authKey, maxRetries) })
+		}
+	})
+	pending[key] = p
+}
+
+// takePending removes and returns the held payload for key, or nil if it has
+// already been flushed.
+func takePending(key string) *pendingFeedback {
+	debounceMu.Lock()
+	defer debounceMu.Unlock()
+	p, ok := pending[key]
+	if !ok {
+		return nil
+	}
+	delete(pending, key)
+	return p
+}
+
+// ── Batching ────────────────────────────────────────────────────────────────
+
+// With Options.BatchSize set, submissions are queued and sent from the
+// background once BatchSize have accumulated. FlushInterval bounds how long a
+// sparse queue waits: each tick sends whatever is queued, however little.
+// Whoever takes the queue's items (size flush, tick, or Close) owns them, so
+// no item is sent twice. While deliveries are backed up the queue is capped
+// at QueueCapacity, with QueuePolicy deciding what gives.
+
+const defaultQueueCapacity = 1000
+
+type queuedFeedback struct {
+	body     []byte
+	authKey  string
+	gapType  string // for drop logs
+	priority string
+}
+
+// rank orders queued items: higher ranks are sent first and dropped last.
+func (it queuedFeedback) rank() int {
+	switch it.priority {
+	case priorityHigh:
+		return 2
+	case priorityLow:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// oldestRanked returns the index of the oldest queued item whose rank is
+// at most maxRank, preferring the lowest rank, or -1 if there is none.
+func (q *batchQueue) oldestRanked(maxRank int) int {
+	found := -1
+	for i, it := range q.items {
+		if it.rank() <= maxRank && (found < 0 || it.rank() < q.items[found].rank()) {
+			found = i
+		}
+	}
+	return found
+}
+
+type batchQueue struct {
+	opts  *Options
+	stop  chan struct{}
+	mu    sync.Mutex
+	items []queuedFeedback
+	space chan struct{} // closed and replaced whenever items are taken
+	full  chan struct{} // capacity 1; wakes the flusher at BatchSize
+}
+
+var (
+	batchMu sync.Mutex
+	queues  = map[*Options]*batchQueue{}
+)
+
+// queueFor returns the queue for opts, starting its flusher on first use.
+func queueFor(opts *Options) *batchQueue {
+	batchMu.Lock()
+	defer batchMu.Unlock()
+	if q, ok := queues[opts]; ok {
+		return q
+	}
+	q := &batchQueue{opts: opts, stop: make(chan struct{}), space: make(chan struct{}), full: make(chan struct{}, 1)}
+	background.Add(1)
+	go q.run(opts.FlushInterval)
+	queues[opts] = q
+	return q
+}
+
+// add queues it. If the queue is at capacity, the oldest lower-priority
+// item makes room; failing that, QueuePolicy applies. It reports whether it
+// was queued.
+func (q *batchQueue) add(ctx context.Context, it queuedFeedback) bool {
+	capacity := q.opts.QueueCapacity
+	if capacity <= 0 {
+		capacity = defaultQueueCapacity
+	}
+	q.mu.Lock()
+	for len(q.items) >= capacity {
+		if i := q.oldestRanked(it.rank() - 1); i >= 0 {
+			dropQueued(q.items[i], q.opts.QueuePolicy)
+			q.items = slices.Delete(q.items, i, i+1)
+			continue
+		}
+		switch q.opts.QueuePolicy {
+		case DropNewest:
+			q.mu.Unlock()
+			dropQueued(it, DropNewest)
+			return false
+		case Block:
+			space := q.space
+			q.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				dropQueued(it, Block)
+				return false
+			case <-space:
+			}
+			q.mu.Lock()
+		default:
+			i := q.oldestRanked(it.rank())
+			if i < 0 {
+				// Everything queued outranks it.
+				q.mu.Unlock()
+				dropQueued(it, DropOldest)
+				return false
+			}
+			dropQueued(q.items[i], DropOldest)
+			q.items = slices.Delete(q.items, i, i+1)
+		}
+	}
+	q.items = append(q.items, it)
+	full := len(q.items) >= q.opts.BatchSize
+	q.mu.Unlock()
+	if full {
+		// A signal already pending covers this batch too.
+		select {
+		case q.full <- struct{}{}:
+		default:
+		}
+	}
+	return true
+}
+
+// take removes and returns everything queued, highest priority first.
+func (q *batchQueue) take() []queuedFeedback {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	items := q.items
+	q.items = nil
+	slices.SortStableFunc(items, func(a, b queuedFeedback) int { return b.rank() - a.rank() })
+	close(q.space)
+	q.space = make(chan struct{})
+	return items
+}
+
+// dropQueued records a submission lost to a full queue.
+func dropQueued(it queuedFeedback, policy QueuePolicy) {
+	logWarning("feedback dropped: queue full (policy %s), gap_type=%s priority=%s", policy, it.gapType, it.priority)
+	stats.recordDrop()
+}
+
+func (q *batchQueue) send(ctx context.Context, items []queuedFeedback) {
+	for _, it := range items {
+		deliver(ctx, it.body, q.opts, it.authKey, maxRetries)
+	}
+}
+
+// run is the queue's single flusher: it sends whatever is queued when add
+// signals a full batch and, with a FlushInterval, on every tick.
+func (q *batchQueue) run(interval time.Duration) {
+	defer background.Done()
+	var tick <-chan time.Time
+	if interval > 0 {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		tick = t.C
+	}
+	for {
+		select {
+		case <-tick:
+		case <-q.full:
+		case <-q.stop:
+			return
+		}
+		if items := q.take(); len(items) > 0 {
+			trackSend(func() { q.send(context.Background(), items) })
+		}
+	}
+}
+
+// ── Health ──────────────────────────────────────────────────────────────────
+
+const healthPath = "/api/stats"
+
+// Ping reports whether the sidecar is reachable. Any HTTP response below 500
+// counts as up; the feedback endpoint itself is never touched.
+// Pass nil for opts to use environment variable defaults.
+func Ping(ctx context.Context, opts *Options) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", opts.url()+healthPath, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	if auth := opts.authenticator(resolveKey(ctx, opts)); auth != nil {
+		auth(req)
+	}
+	resp, err := opts.httpClient().Do(req)
+	if err != nil {
+		return err
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("sidecar returned %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// healthProbe holds the last-known health of one sidecar URL, refreshed by a
+// background Ping loop shared by every submission to that URL.
+type healthProbe struct {
+	mu      sync.Mutex
+	up      bool
+	checked time.Time
+
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+var (
+	healthMu sync.Mutex
+	probes   = map[string]*healthProbe{}
+)
+
+// probeFor returns the probe for opts' sidecar, starting it on first use.
+func probeFor(opts *Options) *healthProbe {
+	healthMu.Lock()
+	defer healthMu.Unlock()
+	url := opts.url()
+	if p, ok := probes[url]; ok {
+		return p
+	}
+	p := &healthProbe{}
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+	probes[url] = p
+	background.Add(1)
+	go p.run(opts)
+	return p
+}
+
+func (p *healthProbe) run(opts *Options) {
+	defer background.Done()
+	ticker := time.NewTicker(opts.HealthProbeInterval)
+	defer ticker.Stop()
+	for {
+		err := Ping(p.ctx, opts)
+		if p.ctx.Err() != nil {
+			return
+		}
+		p.mu.Lock()
+		p.up, p.checked = err == nil, opts.clock().Now()
+		p.mu.Unlock()
+
+		select {
+		case <-p.ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// knownDown reports whether a probe within the staleness window failed.
+// No result yet, or a stale one, counts as unknown and lets delivery proceed.
+func (p *healthProbe) knownDown(now time.Time, staleness time.Duration) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.checked.IsZero() && !p.up && now.Sub(p.checked) <= staleness
+}
+
+// ── Heartbeat ───────────────────────────────────────────────────────────────
+
+// With Options.HeartbeatInterval set, RegisterFeedbackTool also submits a
+// synthetic gap_type=heartbeat record at that interval, tagged
+// synthetic=heartbeat so the sidecar can leave it out of analytics. A gap in
+// heartbeats means the pipeline itself is broken, not that agents went quiet.
+// Heartbeats are sent directly: never debounced, batched, or spooled.
+
+var (
+	heartbeatMu sync.Mutex
+	heartbeats  []context.CancelFunc
+)
+
+func startHeartbeat(serverName string, opts *Options) {
+	ctx, cancel := context.WithCancel(context.Background())
+	heartbeatMu.Lock()
+	heartbeats = append(heartbeats, cancel)
+	heartbeatMu.Unlock()
+
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		t := time.NewTicker(opts.HeartbeatInterval)
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				sendHeartbeat(ctx, serverName, opts)
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+func sendHeartbeat(ctx context.Context, serverName string, opts *Options) {
+	defer recoverBackground("heartbeat")
+	ctx = WithTags(ctx, map[string]string{"synthetic": "heartbeat"})
+	ctx = context.WithValue(ctx, hostRecordContextKey{}, true)
+	ctx = WithIdempotencyKey(ctx, newID()) // content is identical every time
+	sub, res := prepareFeedback(ctx, map[string]any{
+		"what_i_needed": "heartbeat",
+		"what_i_tried":  "heartbeat",
+		"gap_type":      "heartbeat",
+	}, serverName, opts)
+	if sub == nil {
+		logWarning("heartbeat not sent: %s", res.Message)
+		return
+	}
+	if out := post(ctx, sub.body, opts, sub.authKey, 0); !out.ok() && ctx.Err() == nil {
+		logWarning("heartbeat not delivered: %s", out.reason())
+	}
+}
+
+// ── Schema Preflight ────────────────────────────────────────────────────────
+
+const schemaPath = "/api/schema"
+
+// sidecarSchema is the field list served at schemaPath.
+type sidecarSchema struct {
+	Fields   []string `json:"fields"`
+	Required []string `json:"required"`
+}
+
+// payloadFields lists every JSON field name the drop-in can send.
+func payloadFields() []string {
+	t := reflect.TypeFor[Feedback]()
+	fields := make([]string, 0, t.NumField())
+	for i := range t.NumField() {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// CheckSchema fetches the sidecar's accepted fields from /api/schema and
+// reports version skew: fields this drop-in sends that the sidecar would
+// ignore, and fields the sidecar requires that it never sends. A sidecar
+// without the endpoint yields no problems and no error.
+// Pass nil for opts to use environment variable defaults.
+func CheckSchema(ctx context.Context, opts *Options) ([]string, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", opts.url()+schemaPath, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("Accept", "application/json")
+	if auth := opts.authenticator(resolveKey(ctx, opts)); auth != nil {
+		auth(req)
+	}
+	resp, err := opts.httpClient().Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("sidecar returned %d", resp.StatusCode)
+	}
+	var schema sidecarSchema
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(&schema); err != nil {
+		return nil, fmt.Errorf("decoding schema: %w", err)
+	}
+
+	sent := payloadFields()
+	var problems []string
+	for _, f := range sent {
+		if !slices.Contains(schema.Fields, f) {
+			problems = append(problems, fmt.Sprintf("sidecar does not accept field %q", f))
+		}
+	}
+	for _, f := range schema.Required {
+		if !slices.Contains(sent, f) {
+			problems = append(problems, fmt.Sprintf("sidecar requires field %q, which is never sent", f))
+		}
+	}
+	return problems, nil
+}
+
+// preflightSchema runs CheckSchema in the background and logs what it finds.
+// It never blocks registration or fails it.
+func preflightSchema(opts *Options) {
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		ctx, cancel := context.WithTimeout(context.Background(), opts.httpClient().Timeout)
+		defer cancel()
+		problems, err := CheckSchema(ctx, opts)
+		if err != nil {
+			logWarning("schema preflight skipped: %v", err)
+			return
+		}
+		for _, p := range problems {
+			logWarning("schema preflight: %s", p)
+		}
+	}()
+}
+
+// ── Spool ───────────────────────────────────────────────────────────────────
+
+// The spool is a JSON-lines file: a header line identifying the format and
+// version, then one SpoolEntry per line. The format is stable so operators can
+// inspect and reprocess it with their own tooling (jq, log shippers, etc.):
+//
+//	{"format":"patchworkmcp-spool","version":1}
+//	{"payload":{...},"spooled_at":"2025-01-02T03:04:05Z","last_error":"status_503","attempts":1}
+
+const (
+	spoolFormat  = "patchworkmcp-spool"
+	spoolVersion = 1
+)
+
+type spoolHeader struct {
+	Format  string `json:"format"`
+	Version int    `json:"version"`
+}
+
+// SpoolEntry is one undeliverable submission held in the spool.
+type SpoolEntry struct {
+	// Payload is the exact JSON body that would have been posted.
+	Payload json.RawMessage `json:"payload"`
+	// SpooledAt is when the entry was first written.
+	SpooledAt time.Time `json:"spooled_at"`
+	// LastError is the reason the most recent delivery attempt failed.
+	LastError string `json:"last_error,omitempty"`
+	// Attempts counts failed deliveries: the original one plus each replay.
+	Attempts int `json:"attempts,omitempty"`
+}
+
+// SpoolImport reports the result of ImportSpool.
+type SpoolImport struct {
+	Imported int // entries appended to the spool
+	Skipped  int // corrupt or invalid lines
+}
+
+// Serializes every read and write of spool files within the process.
+var spoolMu sync.Mutex
+
+// replayMu allows one replay at a time, so a leftover working file (see
+// claimSpool) can only be from a replay that died.
+var replayMu sync.Mutex
+
+func (e SpoolEntry) valid() bool {
+	var obj map[string]any
+	return len(e.Payload) > 0 && json.Unmarshal(e.Payload, &obj) == nil
+}
+
+// filedAt is when the entry's feedback was filed: the payload's
+// client_timestamp, or SpooledAt for payloads that predate it.
+func (e SpoolEntry) filedAt() time.Time {
+	var p struct {
+		ClientTimestamp string `json:"client_timestamp"`
+	}
+	if json.Unmarshal(e.Payload, &p) == nil {
+		if t, err := time.Parse(time.RFC3339, p.ClientTimestamp); err == nil {
+			return t
+		}
+	}
+	return e.SpooledAt
+}
+
+// dropExpired splits off entries filed more than maxAge before now.
+func dropExpired(entries []SpoolEntry, now time.Time, maxAge time.Duration) (live []SpoolEntry, expired int) {
+	if maxAge <= 0 {
+		return entries, 0
+	}
+	for _, e := range entries {
+		if now.Sub(e.filedAt()) > maxAge {
+			expired++
+			continue
+		}
+		live = append(live, e)
+	}
+	return live, expired
+}
+
+// decodeSpool reads a spool stream, returning valid entries and the number of
+// corrupt lines skipped. A header from a newer format version is an error
+// rather than a guess at its contents.
+func decodeSpool(r io.Reader) ([]SpoolEntry, int, error) {
+	var entries []SpoolEntry
+	skipped := 0
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	first := true
+	for sc.Scan() {
+		line := bytes.TrimSpace(sc.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		if first {
+			first = false
+			var h spoolHeader
+			if json.Unmarshal(line, &h) == nil && h.Format == spoolFormat {
+				if h.Version > spoolVersion {
+					return nil, 0, fmt.Errorf("spool version %d is newer than supported version %d", h.Version, spoolVersion)
+				}
+				continue
+			}
+		}
+		var e SpoolEntry
+		if json.Unmarshal(line, &e) != nil || !e.valid() {
+			skipped++
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, skipped, sc.Err()
+}
+
+// encodeSpool writes a header followed by one line per entry.
+func encodeSpool(w io.Writer, entries []SpoolEntry) error {
+	enc := json.NewEncoder(w)
+	if err := enc.Encode(spoolHeader{Format: spoolFormat, Version: spoolVersion}); err != nil {
+		return err
+	}
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readSpoolLocked loads the spool at path. A missing file is an empty spool.
+// Callers must hold spoolMu.
+func readSpoolLocked(path string) ([]SpoolEntry, int, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+	return decodeSpool(f)
+}
+
+// appendSpoolLocked appends entries to the spool at path, writing the header
+// first if the file is new. Callers must hold spoolMu.
+func appendSpoolLocked(path string, entries ...SpoolEntry) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	enc := json.NewEncoder(f)
+	if info.Size() == 0 {
+		if err := enc.Encode(spoolHeader{Format: spoolFormat, Version: spoolVersion}); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	return f.Close()
+}
+
+func appendSpool(path string, entries ...SpoolEntry) error {
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+	return appendSpoolLocked(path, entries...)
+}
+
+// replayPath is the working file a replay moves the spool to, so new
+// submissions can keep spooling while it runs.
+func replayPath(path string) string { return path + ".replay" }
+
+// claimSpool moves the spool at path to its working file and returns the
+// entries. The working file stays on disk until finishReplay, so a replay
+// that is killed partway loses nothing. Callers must hold replayMu.
+func claimSpool(path string) ([]SpoolEntry, error) {
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+	if err := restoreSpoolLocked(path); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(path, replayPath(path)); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	entries, _, err := readSpoolLocked(replayPath(path))
+	return entries, err
+}
+
+// finishReplay replaces the working file with keep plus anything spooled
+// since the replay began. The new spool is written in full and renamed into
+// place before the working file goes, so a crash in between can only
+// duplicate entries, never drop them.
+func finishReplay(path string, keep []SpoolEntry) error {
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+	added, _, err := readSpoolLocked(path)
+	if err != nil {
+		return err
+	}
+	if all := append(keep, added...); len(all) > 0 {
+		if err := writeSpoolLocked(path, all); err != nil {
+			return err
+		}
+	} else if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Remove(replayPath(path))
+}
+
+// restoreSpoolLocked merges the working file of a replay that died back into
+// the spool. Callers must hold spoolMu and replayMu.
+func restoreSpoolLocked(path string) error {
+	if _, err := os.Stat(replayPath(path)); errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	left, _, err := readSpoolLocked(replayPath(path))
+	if err != nil {
+		return err
+	}
+	current, _, err := readSpoolLocked(path)
+	if err != nil {
+		return err
+	}
+	if len(left) > 0 {
+		logWarning("spool: recovered %d entries from an interrupted replay", len(left))
+	}
+	if err := writeSpoolLocked(path, append(left, current...)); err != nil {
+		return err
+	}
+	return os.Remove(replayPath(path))
+}
+
+// recoverSpool restores an interrupted replay's entries to the spool, if
+// there are any. It runs at registration so they are visible to ListSpool
+// and the status resource before the next replay.
+func recoverSpool(opts *Options) {
+	path := opts.spoolPath()
+	if path == "" {
+		return
+	}
+	replayMu.Lock()
+	defer replayMu.Unlock()
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+	if err := restoreSpoolLocked(path); err != nil {
+		logWarning("spool: recovering interrupted replay: %v", err)
+	}
+}
+
+// writeSpoolLocked atomically replaces the spool at path with entries.
+// Callers must hold spoolMu.
+func writeSpoolLocked(path string, entries []SpoolEntry) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+	if err := encodeSpool(f, entries); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// ReplaySpool retries every spooled submission, removing the ones that are
+// delivered and keeping the rest (with their latest error) for next time.
+// Entries spooled while a replay runs are preserved, as are entries beyond
+// the ReplayMaxItems or ReplayMaxDuration limits. A replay that is killed
+// partway leaves its entries in a working file beside the spool, which the
+// next replay or registration restores; at worst some are sent twice, and
+// their idempotency keys let the sidecar drop the repeats. Returns the
+// number delivered. Pass nil for opts to use environment variable defaults.
+func ReplaySpool(ctx context.Context, opts *Options) (int, error) {
+	return RedriveSpool(ctx, nil, opts)
+}
+
+// ListSpool returns the spooled submissions without touching them, for
+// inspection before a RedriveSpool. Corrupt lines are left out.
+// Pass nil for opts to use environment variable defaults.
+func ListSpool(opts *Options) ([]SpoolEntry, error) {
+	path := opts.spoolPath()
+	if path == "" {
+		return nil, errors.New("no spool configured")
+	}
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+	entries, _, err := readSpoolLocked(path)
+	return entries, err
+}
+
+// RedriveSpool is ReplaySpool restricted to the entries filter accepts (e.g.
+// only those whose LastError is a 503). Entries it rejects stay in the spool
+// untouched. A nil filter accepts everything.
+// Pass nil for opts to use environment variable defaults.
+func RedriveSpool(ctx context.Context, filter func(SpoolEntry) bool, opts *Options) (int, error) {
+	path := opts.spoolPath()
+	if path == "" {
+		return 0, errors.New("no spool configured")
+	}
+	replayMu.Lock()
+	defer replayMu.Unlock()
+	entries, err := claimSpool(path)
+	if err != nil {
+		return 0, err
+	}
+	if opts != nil {
+		var expired int
+		entries, expired = dropExpired(entries, opts.clock().Now(), opts.SpoolMaxAge)
+		if expired > 0 {
+			logWarning("spool: expired %d entries older than %s", expired, opts.SpoolMaxAge)
+		}
+	}
+	authKey := resolveKey(ctx, opts)
+	runCtx, retries, maxItems := ctx, maxRetries, len(entries)
+	if opts != nil {
+		if opts.ReplayMaxDuration > 0 {
+			var cancel context.CancelFunc
+			runCtx, cancel = context.WithTimeout(ctx, opts.ReplayMaxDuration)
+			defer cancel()
+		}
+		if opts.ReplayMaxItems > 0 {
+			maxItems = opts.ReplayMaxItems
+		}
+		if opts.ReplayQuickFail {
+			retries = 0
+		}
+	}
+	delivered, attempted := 0, 0
+	var keep []SpoolEntry
+	for _, e := range entries {
+		if runCtx.Err() != nil || attempted >= maxItems || (filter != nil && !filter(e)) {
+			keep = append(keep, e)
+			continue
+		}
+		attempted++
+		out := post(runCtx, e.Payload, opts, authKey, retries)
+		if out.ok() {
+			delivered++
+			continue
+		}
+		if runCtx.Err() != nil {
+			keep = append(keep, e) // cut off by the run limit, not a real attempt
+			continue
+		}
+		e.LastError = out.reason()
+		e.Attempts++
+		keep = append(keep, e)
+	}
+	if err := finishReplay(path, keep); err != nil {
+		// The working file still holds every entry; the next replay or
+		// registration restores it.
+		return delivered, err
+	}
+	return delivered, ctx.Err()
+}
+
+// SweepSpool removes spooled feedback older than Options.SpoolMaxAge without
+// replaying anything, and returns how many entries expired. Corrupt lines
+// are dropped when the spool is rewritten.
+// Pass nil for opts to use environment variable defaults.
+func SweepSpool(opts *Options) (int, error) {
+	path := opts.spoolPath()
+	if path == "" {
+		return 0, errors.New("no spool configured")
+	}
+	if opts == nil || opts.SpoolMaxAge <= 0 {
+		return 0, nil
+	}
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+	entries, _, err := readSpoolLocked(path)
+	if err != nil {
+		return 0, err
+	}
+	live, expired := dropExpired(entries, opts.clock().Now(), opts.SpoolMaxAge)
+	if expired == 0 {
+		return 0, nil
+	}
+	return expired, writeSpoolLocked(path, live)
+}
+
+const spoolSweepInterval = time.Hour
+
+var (
+	sweepMu  sync.Mutex
+	sweepers = map[string]context.CancelFunc{}
+)
+
+// startSpoolSweeper runs SweepSpool for path in the background until Close,
+// starting at most one sweeper per path.
+func startSpoolSweeper(path string, opts *Options) {
+	sweepMu.Lock()
+	defer sweepMu.Unlock()
+	if _, ok := sweepers[path]; ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	sweepers[path] = cancel
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		t := time.NewTicker(min(spoolSweepInterval, opts.SpoolMaxAge))
+		defer t.Stop()
+		for {
+			select {
+			case <-t.C:
+				if n, err := SweepSpool(opts); err != nil {
+					logWarning("spool sweep failed: %v", err)
+				} else if n > 0 {
+					logWarning("spool: expired %d entries older than %s", n, opts.SpoolMaxAge)
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// ExportSpool writes the spool in its stable JSON-lines format (header line
+// first) and returns the number of entries written. Corrupt lines in the
+// spool file are left out. Pass nil for opts to use environment defaults.
+func ExportSpool(w io.Writer, opts *Options) (int, error) {
+	path := opts.spoolPath()
+	if path == "" {
+		return 0, errors.New("no spool configured")
+	}
+	spoolMu.Lock()
+	entries, _, err := readSpoolLocked(path)
+	spoolMu.Unlock()
+	if err != nil {
+		return 0, err
+	}
+	return len(entries), encodeSpool(w, entries)
+}
+
+// ImportSpool appends entries from a JSON-lines stream (as produced by
+// ExportSpool) to the spool. Lines that are not valid entries are skipped and
+// counted; a header from a newer format version rejects the whole import.
+// Pass nil for opts to use environment variable defaults.
+func ImportSpool(r io.Reader, opts *Options) (SpoolImport, error) {
+	path := opts.spoolPath()
+	if path == "" {
+		return SpoolImport{}, errors.New("no spool configured")
+	}
+	entries, skipped, err := decodeSpool(r)
+	if err != nil {
+		return SpoolImport{Skipped: skipped}, err
+	}
+	if len(entries) > 0 {
+		if err := appendSpool(path, entries...); err != nil {
+			return SpoolImport{Skipped: skipped}, err
+		}
+	}
+	return SpoolImport{Imported: len(entries), Skipped: skipped}, nil
+}
+
+// ── Shutdown ────────────────────────────────────────────────────────────────
+
+// Close flushes any debounced or queued feedback immediately, stops health
+// probes, heartbeats, batch flushers, and spool sweeps, and waits for
+// background deliveries to finish. Call it from the host's shutdown path so
+// held submissions are not lost on exit. Returns ctx.Err() if ctx expires
+// first.
+func Close(ctx context.Context) error {
+	healthMu.Lock()
+	for url, p := range probes {
+		p.cancel()
+		delete(probes, url)
+	}
+	healthMu.Unlock()
+
+	heartbeatMu.Lock()
+	for _, cancel := range heartbeats {
+		cancel()
+	}
+	heartbeats = nil
+	heartbeatMu.Unlock()
+
+	sweepMu.Lock()
+	for path, cancel := range sweepers {
+		cancel()
+		delete(sweepers, path)
+	}
+	sweepMu.Unlock()
+
+	debounceMu.Lock()
+	keys := make([]string, 0, len(pending))
+	for k, p := range pending {
+		if p.timer.Stop() {
+			// The timer's callback will never run, so release its slot here.
+			background.Done()
+			keys = append(keys, k)
+		}
+	}
+	debounceMu.Unlock()
+
+	for _, k := range keys {
+		if p := takePending(k); p != nil {
+			deliver(ctx, p.body, p.opts, p.authKey, maxRetries)
+		}
+	}
+
+	batchMu.Lock()
+	flush := make([]*batchQueue, 0, len(queues))
+	for o, q := range queues {
+		close(q.stop)
+		delete(queues, o)
+		flush = append(flush, q)
+	}
+	batchMu.Unlock()
+
+	for _, q := range flush {
+		q.send(ctx, q.take())
+	}
+
+	done := make(chan struct{})
+	go func() {
+		background.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ── Status ──────────────────────────────────────────────────────────────────
+
+// With Options.ExposeStatusResource, RegisterFeedbackTool also registers a
+// read-only feedback://status resource so an agent or operator can check
+// whether feedback is actually reaching the sidecar.
+
+const statusURI = "feedback://status"
+
+// deliveryStats counts delivery outcomes across every submission in the
+// process.
+type deliveryStats struct {
+	mu            sync.Mutex
+	delivered     int
+	failed        int
+	lastDelivered time.Time
+	lastFailed    time.Time
+	lastError     string
+	// encodingErrors counts submissions that were never sent because they
+	// couldn't be encoded; they are not included in failed.
+	encodingErrors int
+	// dropped counts submissions lost to a full batch queue.
+	dropped int
+	// latency is a histogram of delivery time, retries included, with
+	// latencyCounts[i] counting deliveries of at most latencyBuckets[i] and
+	// the last slot the rest.
+	latencyCounts [len(latencyBuckets) + 1]int
+	latencySum    time.Duration
+	// paths counts outcomes by routing path, shadow sends included.
+	paths map[string]*pathCounts
+	// fieldBytes are histograms of raw field lengths by JSON name, kept
+	// with Options.ReportFieldLengths.
+	fieldBytes map[string]*fieldHistogram
+}
+
+// fieldByteBuckets are the histogram bounds for field lengths; they bracket
+// the built-in FieldLimits.
+var fieldByteBuckets = [...]int{64, 128, 256, 512, 1000, 2000, 4000, 8000, 16000}
+
+type fieldHistogram struct {
+	counts [len(fieldByteBuckets) + 1]int
+	sum    int
+}
+
+// recordFieldLengths adds the length of each of fields as the agent sent
+// it in args, skipping fields that were absent or not strings.
+func (s *deliveryStats) recordFieldLengths(args map[string]any, fields []namedField) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.fieldBytes == nil {
+		s.fieldBytes = make(map[string]*fieldHistogram)
+	}
+	for _, f := range fields {
+		v, ok := args[f.name].(string)
+		if !ok {
+			continue
+		}
+		h := s.fieldBytes[f.name]
+		if h == nil {
+			h = &fieldHistogram{}
+			s.fieldBytes[f.name] = h
+		}
+		i := 0
+		for i < len(fieldByteBuckets) && len(v) > fieldByteBuckets[i] {
+			i++
+		}
+		h.counts[i]++
+		h.sum += len(v)
+	}
+}
+
+type pathCounts struct{ delivered, failed int }
+
+// latencyBuckets are the histogram bounds for delivery time.
+var latencyBuckets = [...]time.Duration{
+	50 * time.Millisecond, 100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second, 10 * time.Second,
+}
+
+var stats deliveryStats
+
+func (s *deliveryStats) record(out outcome, now time.Time, latency time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	i := 0
+	for i < len(latencyBuckets) && latency > latencyBuckets[i] {
+		i++
+	}
+	s.latencyCounts[i]++
+	s.latencySum += latency
+	s.recordPathLocked(out.path, out.ok())
+	if out.ok() {
+		s.delivered++
+		s.lastDelivered = now
+		return
+	}
+	s.failed++
+	s.lastFailed = now
+	s.lastError = out.reason()
+}
+
+// recordPath counts one outcome for path without touching the totals, for
+// sends that aren't submissions in their own right, like shadow copies.
+func (s *deliveryStats) recordPath(path string, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recordPathLocked(path, ok)
+}
+
+func (s *deliveryStats) recordPathLocked(path string, ok bool) {
+	if path == "" {
+		return
+	}
+	if s.paths == nil {
+		s.paths = make(map[string]*pathCounts)
+	}
+	c := s.paths[path]
+	if c == nil {
+		c = &pathCounts{}
+		s.paths[path] = c
+	}
+	if ok {
+		c.delivered++
+	} else {
+		c.failed++
+	}
+}
+
+func (s *deliveryStats) recordDrop() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.dropped++
+}
+
+func (s *deliveryStats) recordEncodingError(reason string, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.encodingErrors++
+	s.lastFailed = now
+	s.lastError = reason
+}
+
+// feedbackStatus is the body of the status resource. It summarizes
+// configuration without exposing credentials.
+type feedbackStatus struct {
+	SidecarURL      string     `json:"sidecar_url"`
+	AuthConfigured  bool       `json:"auth_configured"`
+	Delivered       int        `json:"delivered"`
+	Failed          int        `json:"failed"`
+	EncodingErrors  int        `json:"encoding_errors"`
+	Dropped         int        `json:"dropped"`
+	LastDelivered   *time.Time `json:"last_delivered,omitempty"`
+	LastFailure     *time.Time `json:"last_failure,omitempty"`
+	LastError       string     `json:"last_error,omitempty"`
+	Inflight        int        `json:"inflight"`
+	SpoolConfigured bool       `json:"spool_configured"`
+	SpoolEntries    int        `json:"spool_entries"`
+}
+
+func currentStatus(opts *Options) feedbackStatus {
+	st := feedbackStatus{
+		SidecarURL:      opts.url(),
+		AuthConfigured:  opts.authenticator(opts.key()) != nil,
+		Inflight:        InflightCount(),
+		SpoolConfigured: opts.spoolPath() != "",
+	}
+	if u, err := url.Parse(st.SidecarURL); err == nil {
+		st.SidecarURL = u.Redacted()
+	}
+	stats.mu.Lock()
+	st.Delivered, st.Failed, st.LastError = stats.delivered, stats.failed, stats.lastError
+	st.EncodingErrors, st.Dropped = stats.encodingErrors, stats.dropped
+	if !stats.lastDelivered.IsZero() {
+		t := stats.lastDelivered
+		st.LastDelivered = &t
+	}
+	if !stats.lastFailed.IsZero() {
+		t := stats.lastFailed
+		st.LastFailure = &t
+	}
+	stats.mu.Unlock()
+	if st.SpoolConfigured {
+		if entries, err := ListSpool(opts); err == nil {
+			st.SpoolEntries = len(entries)
+		}
+	}
+	return st
+}
+
+func registerStatusResource(s *server.MCPServer, opts *Options) {
+	resource := mcp.NewResource(statusURI, "Feedback status",
+		mcp.WithResourceDescription("Whether feedback from this server is reaching the PatchworkMCP sidecar."),
+		mcp.WithMIMEType("application/json"),
+	)
+	s.AddResource(resource, func(ctx context.Context, req mcp.ReadResourceRequest) ([]mcp.ResourceContents, error) {
+		body, err := json.MarshalIndent(currentStatus(opts), "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return []mcp.ResourceContents{mcp.TextResourceContents{
+			URI:      statusURI,
+			MIMEType: "application/json",
+			Text:     string(body),
+		}}, nil
+	})
+}
+
+// ── Metrics ─────────────────────────────────────────────────────────────────
+
+const metricsPrefix = "patchworkmcp_feedback_"
+
+// WriteMetrics renders the process-wide delivery stats — the same counters
+// the status resource reports, plus a delivery latency histogram — in
+// OpenMetrics text format, for scraping without a Prometheus dependency.
+// Serve it from the host's metrics handler:
+//
+//	http.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+//	    w.Header().Set("Content-Type", "application/openmetrics-text; version=1.0.0; charset=utf-8")
+//	    feedback.WriteMetrics(w)
+//	})
+func WriteMetrics(w io.Writer) error {
+	stats.mu.Lock()
+	delivered, failed, encodingErrors, dropped := stats.delivered, stats.failed, stats.encodingErrors, stats.dropped
+	latencyCounts, latencySum := stats.latencyCounts, stats.latencySum
+	paths := make(map[string]pathCounts, len(stats.paths))
+	for p, c := range stats.paths {
+		paths[p] = *c
+	}
+	fieldBytes := make(map[string]fieldHistogram, len(stats.fieldBytes))
+	for f, h := range stats.fieldBytes {
+		fieldBytes[f] = *h
+	}
+	stats.mu.Unlock()
+
+	var b strings.Builder
+	counter := func(name, help string, v int) {
+		fmt.Fprintf(&b, "# TYPE %s%s counter\n# HELP %s%s %s\n%s%s_total %d\n",
+			metricsPrefix, name, metricsPrefix, name, help, metricsPrefix, name, v)
+	}
+	counter("delivered", "Submissions the sidecar accepted.", delivered)
+	counter("failed", "Submissions that exhausted delivery attempts.", failed)
+	counter("encoding_errors", "Submissions that could not be encoded.", encodingErrors)
+	counter("dropped", "Submissions dropped from a full batch queue.", dropped)
+	fmt.Fprintf(&b, "# TYPE %spath counter\n# HELP %spath Sends by routing path and result; shadow sends are separate from the totals.\n",
+		metricsPrefix, metricsPrefix)
+	for _, p := range slices.Sorted(maps.Keys(paths)) {
+		fmt.Fprintf(&b, "%spath_total{path=%q,result=\"delivered\"} %d\n", metricsPrefix, p, paths[p].delivered)
+		fmt.Fprintf(&b, "%spath_total{path=%q,result=\"failed\"} %d\n", metricsPrefix, p, paths[p].failed)
+	}
+	fmt.Fprintf(&b, "# TYPE %sinflight gauge\n# HELP %sinflight Background deliveries running or waiting.\n%sinflight %d\n",
+		metricsPrefix, metricsPrefix, metricsPrefix, InflightCount())
+
+	name := metricsPrefix + "delivery_seconds"
+	fmt.Fprintf(&b, "# TYPE %s histogram\n# HELP %s Time to deliver or give up, retries included.\n", name, name)
+	count := 0
+	for i, n := range latencyCounts {
+		count += n
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = strconv.FormatFloat(latencyBuckets[i].Seconds(), 'f', -1, 64)
+		}
+		fmt.Fprintf(&b, "%s_bucket{le=%q} %d\n", name, le, count)
+	}
+	fmt.Fprintf(&b, "%s_sum %g\n%s_count %d\n", name, latencySum.Seconds(), name, count)
+
+	if len(fieldBytes) > 0 {
+		name = metricsPrefix + "field_bytes"
+		fmt.Fprintf(&b, "# TYPE %s histogram\n# HELP %s Length of each text field as sent, before truncation.\n", name, name)
+		for _, f := range slices.Sorted(maps.Keys(fieldBytes)) {
+			h := fieldBytes[f]
+			count := 0
+			for i, n := range h.counts {
+				count += n
+				le := "+Inf"
+				if i < len(fieldByteBuckets) {
+					le = strconv.Itoa(fieldByteBuckets[i])
+				}
+				fmt.Fprintf(&b, "%s_bucket{field=%q,le=%q} %d\n", name, f, le, count)
+			}
+			fmt.Fprintf(&b, "%s_sum{field=%q} %d\n%s_count{field=%q} %d\n", name, f, h.sum, name, f, count)
+		}
+	}
+	b.WriteString("# EOF\n")
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// ── Handler & Registration ──────────────────────────────────────────────────
+
+// NewFeedbackHandler returns a tool handler function bound to a server name.
+// Pass nil for opts to use environment variable defaults.
+func NewFeedbackHandler(serverName string, opts *Options) server.ToolHandlerFunc {
+	return func(ctx context.Context, req mcp.CallToolRequest) (*mcp.CallToolResult, error) {
+		if _, ok := ctx.Value(requestIDContextKey{}).(string); !ok {
+			ctx = WithRequestID(ctx, newID())
+		}
+		args := req.GetArguments()
+		res := safeSubmit(ctx, args, serverName, opts)
+		if res.Rejected {
+			return mcp.NewToolResultError(res.Message), nil
+		}
+		return mcp.NewToolResultText(res.Message), nil
+	}
+}
+
+// safeSubmit is SubmitFeedback for handlers: a panic anywhere in processing,
+// including user hooks like ToolClassifier or OnUnsent, is logged with its
+// stack and reported as a failed submission instead of crashing the host.
+// Hooks that run later in background sends are covered by trackSend.
+func safeSubmit(ctx context.Context, args map[string]any, serverName string, opts *Options) (res Result) {
+	defer func() {
+		if r := recover(); r != nil {
+			logWarning("feedback processing panicked: %v\n%s", r, debug.Stack())
+			res = Result{Message: "Feedback processing failed; nothing was sent."}
+		}
+	}()
+	return SubmitFeedback(ctx, args, serverName, opts)
+}
+
+// maxIngressBytes bounds request bodies accepted by FeedbackHTTPHandler.
+const maxIngressBytes = 1 << 20
+
+// FeedbackHTTPHandler returns an ingress adapter that lets non-MCP services in
+// the same process emit feedback with the same client, validation, retries,
+// and spooling as the MCP tool. It accepts a JSON POST with the tool's
+// argument fields and forwards it via SubmitFeedback. It is not a sidecar
+// replacement: nothing is stored here, and it has no auth of its own, so
+// mount it behind the host's middleware.
+//
+//	mux.Handle("/internal/feedback", feedback.FeedbackHTTPHandler("billing-api", nil))
+//
+// Responds 201 when delivered, 202 when spooled or logged, 422 when the
+// submission was rejected, and 400/405 for malformed requests.
+func FeedbackHTTPHandler(serverName string, opts *Options) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var args map[string]any
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxIngressBytes)).Decode(&args); err != nil || args == nil {
+			http.Error(w, "request body must be a JSON object", http.StatusBadRequest)
+			return
+		}
+
+		res := safeSubmit(r.Context(), args, serverName, opts)
+		status := http.StatusAccepted
+		switch {
+		case res.Rejected:
+			status = http.StatusUnprocessableEntity
+		case res.Delivered:
+			status = http.StatusCreated
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(struct {
+			Message   string `json:"message"`
+			Delivered bool   `json:"delivered"`
+			Spooled   bool   `json:"spooled"`
+			Rejected  bool   `json:"rejected"`
+		}{res.Message, res.Delivered, res.Spooled, res.Rejected})
+	}
+}
+
+// RegisterFeedbackTool is a one-liner to add the feedback tool to an MCP server.
+// Pass nil for opts to use environment variable defaults.
+//
+//	s := server.NewMCPServer("my-server", "1.0.0")
+//	feedback.RegisterFeedbackTool(s, "my-server", nil)
+//
+//	// Or point at a specific sidecar:
+//	feedback.RegisterFeedbackTool(s, "my-server", &feedback.Options{
+//	    SidecarURL: "https://feedback.prod.example.com",
+//	})
+func RegisterFeedbackTool(s *server.MCPServer, serverName string, opts *Options) {
+	s.AddTool(NewFeedbackToolWithOptions(opts), NewFeedbackHandler(serverName, opts))
+	startRegistered(serverName, opts)
+	if opts != nil && opts.ExposeStatusResource {
+		registerStatusResource(s, opts)
+	}
+}
+
+// RegisterFeedbackToolWithShutdown is RegisterFeedbackTool plus the matching
+// shutdown hook, so queued feedback isn't silently dropped on exit. Call the
+// returned function from the host's signal handler: it runs Close, then
+// makes one last attempt to deliver anything in the spool, if configured.
+// Pass nil for opts to use environment variable defaults.
+//
+//	shutdown := feedback.RegisterFeedbackToolWithShutdown(s, "my-server", nil)
+//	sig := make(chan os.Signal, 1)
+//	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+//	go func() {
+//	    <-sig
+//	    ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+//	    defer cancel()
+//	    shutdown(ctx)
+//	    os.Exit(0)
+//	}()
+func RegisterFeedbackToolWithShutdown(s *server.MCPServer, serverName string, opts *Options) (shutdown func(context.Context) error) {
+	RegisterFeedbackTool(s, serverName, opts)
+	return func(ctx context.Context) error {
+		if err := Close(ctx); err != nil {
+			return err
+		}
+		if opts.spoolPath() == "" {
+			return nil
+		}
+		_, err := ReplaySpool(ctx, opts)
+		return err
+	}
+}
+
+// startRegistered starts the optional background work that registration
+// enables, whichever MCP library the tool was registered with.
+func startRegistered(serverName string, opts *Options) {
+	recoverSpool(opts)
+	if opts != nil && opts.SchemaPreflight {
+		preflightSchema(opts)
+	}
+	if opts != nil && opts.HeartbeatInterval > 0 {
+		startHeartbeat(serverName, opts)
+	}
 }
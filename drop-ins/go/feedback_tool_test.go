@@ -0,0 +1,1013 @@
+package feedback
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeClock fires every After at once and records the requested delays.
+type fakeClock struct {
+	mu     sync.Mutex
+	delays []time.Duration
+}
+
+func (c *fakeClock) Now() time.Time { return time.Now() }
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	c.delays = append(c.delays, d)
+	c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	ch <- time.Now()
+	return ch
+}
+
+func (c *fakeClock) take() []time.Duration {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	d := c.delays
+	c.delays = nil
+	return d
+}
+
+// scriptedTransport fails with a retryable error while fail is positive.
+type scriptedTransport struct {
+	mu    sync.Mutex
+	fail  int
+	calls int
+}
+
+func (t *scriptedTransport) Deliver(ctx context.Context, body []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.calls++
+	if t.fail > 0 {
+		t.fail--
+		return &DeliveryError{Err: errors.New("unavailable"), StatusCode: 503, Retryable: true}
+	}
+	return nil
+}
+
+func (t *scriptedTransport) count() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.calls
+}
+
+func testArgs(what string) map[string]any {
+	return map[string]any{"what_i_needed": what, "what_i_tried": "searched the tool list", "gap_type": "missing_tool"}
+}
+
+func TestBackoffRestartsEachCall(t *testing.T) {
+	clock := &fakeClock{}
+	tr := &scriptedTransport{fail: 2}
+	opts := &Options{Transport: tr, Clock: clock}
+
+	if res := SubmitFeedback(context.Background(), testArgs("first"), "test", opts); !res.Delivered {
+		t.Fatalf("first submission not delivered: %q", res.Message)
+	}
+	if got, want := clock.take(), []time.Duration{initialBackoff, 2 * initialBackoff}; !slices.Equal(got, want) {
+		t.Fatalf("first call delays = %v, want %v", got, want)
+	}
+
+	tr.fail = 1
+	if res := SubmitFeedback(context.Background(), testArgs("second"), "test", opts); !res.Delivered {
+		t.Fatalf("second submission not delivered: %q", res.Message)
+	}
+	if got, want := clock.take(), []time.Duration{initialBackoff}; !slices.Equal(got, want) {
+		t.Fatalf("second call delays = %v, want %v (stale backoff carried over)", got, want)
+	}
+}
+
+func TestEncodingFallsBackToJSON(t *testing.T) {
+	var mu sync.Mutex
+	var types []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		types = append(types, r.Header.Get("Content-Type"))
+		mu.Unlock()
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	opts := &Options{SidecarURL: srv.URL, Encoding: &Encoding{ContentType: "application/x-test", Marshal: json.Marshal}}
+
+	for _, what := range []string{"first", "second"} {
+		if res := SubmitFeedback(context.Background(), testArgs(what), "test", opts); !res.Delivered {
+			t.Fatalf("%s submission not delivered: %q", what, res.Message)
+		}
+	}
+	want := []string{"application/x-test", "application/json", "application/json"}
+	if !slices.Equal(types, want) {
+		t.Fatalf("content types = %v, want %v", types, want)
+	}
+}
+
+func TestStageCancelledContext(t *testing.T) {
+	tr := &scriptedTransport{}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	st := Stage(ctx, testArgs("staged"), "test", &Options{Transport: tr})
+	time.Sleep(10 * time.Millisecond) // let the AfterFunc discard run
+	if res := st.Commit(context.Background()); res.Delivered || tr.count() != 0 {
+		t.Fatalf("cancelled staged feedback was sent: %+v", res)
+	}
+}
+
+func TestBackgroundHookPanicRecovered(t *testing.T) {
+	tr := &scriptedTransport{fail: 1 << 20}
+	opts := &Options{
+		Transport:        tr,
+		Clock:            &fakeClock{},
+		DebounceInterval: time.Millisecond,
+		OnUnsent:         func(UnsentLine) { panic("hook bug") },
+	}
+	args := testArgs("debounced")
+	args["session_id"] = "s-panic"
+	SubmitFeedback(context.Background(), args, "test", opts)
+	// The process survives the panic and the send is no longer in flight.
+	deadline := time.Now().Add(2 * time.Second)
+	for InflightCount() != 0 || tr.count() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("background send still running: inflight=%d calls=%d", InflightCount(), tr.count())
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestBackgroundSendsDoNotLeak(t *testing.T) {
+	tr := &scriptedTransport{}
+	opts := &Options{Transport: tr, DebounceInterval: time.Millisecond}
+	baseline := runtime.NumGoroutine()
+
+	const sends = 200
+	for i := range sends {
+		args := testArgs(fmt.Sprintf("fire and forget %d", i))
+		args["session_id"] = fmt.Sprintf("leak-%d", i)
+		SubmitFeedback(context.Background(), args, "test", opts)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := Close(ctx); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if n := InflightCount(); n != 0 {
+		t.Fatalf("InflightCount after Close = %d, want 0", n)
+	}
+	if got := tr.count(); got != sends {
+		t.Fatalf("delivered %d, want %d", got, sends)
+	}
+	deadline := time.Now().Add(time.Second)
+	for runtime.NumGoroutine() > baseline {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines = %d after Close, baseline %d", runtime.NumGoroutine(), baseline)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestDerivedClientReusesConnections(t *testing.T) {
+	var conns atomic.Int32
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	}))
+	srv.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	srv.Start()
+	defer srv.Close()
+	opts := &Options{SidecarURL: srv.URL, Timeout: 3 * time.Second}
+
+	for i := range 5 {
+		if res := SubmitFeedback(context.Background(), testArgs(fmt.Sprintf("pooled %d", i)), "test", opts); !res.Delivered {
+			t.Fatalf("submission %d not delivered: %q", i, res.Message)
+		}
+	}
+	if n := conns.Load(); n != 1 {
+		t.Fatalf("opened %d connections for 5 sends, want 1", n)
+	}
+	if clientFor(3*time.Second, nil) != clientFor(3*time.Second, nil) {
+		t.Fatal("identical settings got different clients")
+	}
+}
+
+func TestRequireSessionIDExemptsHostRecords(t *testing.T) {
+	tr := &scriptedTransport{}
+	opts := &Options{Transport: tr, RequireSessionID: true}
+
+	if res := SubmitFeedback(context.Background(), testArgs("no session"), "test", opts); !res.Rejected {
+		t.Fatalf("agent feedback without session_id not rejected: %+v", res)
+	}
+	spoofed := WithTags(context.Background(), map[string]string{"synthetic": "missing_tool"})
+	if res := SubmitFeedback(spoofed, testArgs("no session"), "test", opts); !res.Rejected {
+		t.Fatalf("synthetic tag bypassed RequireSessionID: %+v", res)
+	}
+	if res := ReportMissingTool(context.Background(), "export_csv", "test", opts); !res.Delivered {
+		t.Fatalf("ReportMissingTool not delivered: %+v", res)
+	}
+	sendHeartbeat(context.Background(), "test", opts)
+	if got := tr.count(); got != 2 {
+		t.Fatalf("delivered %d host records, want 2", got)
+	}
+}
+
+// recordingSidecar accepts every submission and records the Authorization
+// header of each.
+func recordingSidecar(t *testing.T) (*httptest.Server, func() []string) {
+	var mu sync.Mutex
+	var auths []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		auths = append(auths, r.Header.Get("Authorization"))
+		mu.Unlock()
+		w.WriteHeader(http.StatusCreated)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(auths)
+	}
+}
+
+func TestShadowUsesItsOwnCredentials(t *testing.T) {
+	primary, primaryAuths := recordingSidecar(t)
+	shadow, shadowAuths := recordingSidecar(t)
+	opts := &Options{SidecarURL: primary.URL, APIKey: "primary-key", ShadowURL: shadow.URL, ShadowAPIKey: "shadow-key"}
+
+	if res := SubmitFeedback(context.Background(), testArgs("mirrored"), "test", opts); !res.Delivered {
+		t.Fatalf("not delivered: %q", res.Message)
+	}
+	if err := Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if got := primaryAuths(); !slices.Equal(got, []string{"Bearer primary-key"}) {
+		t.Fatalf("primary saw %q", got)
+	}
+	if got := shadowAuths(); !slices.Equal(got, []string{"Bearer shadow-key"}) {
+		t.Fatalf("shadow saw %q", got)
+	}
+}
+
+func TestResolveToolsPrecedence(t *testing.T) {
+	agentForms := map[string]any{
+		"none":     nil,
+		"string":   "search, fetch",
+		"array":    []any{"search", "fetch"},
+		"[]string": []string{"search", "fetch"},
+	}
+	host := []string{"fetch", "export"}
+	type toolsCase struct {
+		agent      string
+		host       bool
+		precedence ToolsPrecedence
+		want       []string
+	}
+	tests := []toolsCase{
+		{"none", false, ToolsHostWins, nil},
+		{"none", true, ToolsHostWins, []string{"fetch", "export"}},
+		{"none", true, ToolsMerge, []string{"fetch", "export"}},
+	}
+	for _, form := range []string{"string", "array", "[]string"} {
+		tests = append(tests,
+			toolsCase{form, false, ToolsHostWins, []string{"search", "fetch"}},
+			toolsCase{form, false, ToolsMerge, []string{"search", "fetch"}},
+			toolsCase{form, true, ToolsHostWins, []string{"fetch", "export"}},
+			toolsCase{form, true, ToolsMerge, []string{"fetch", "export", "search"}},
+		)
+	}
+	for _, tt := range tests {
+		args := map[string]any{}
+		if v := agentForms[tt.agent]; v != nil {
+			args["tools_available"] = v
+		}
+		ctx := context.Background()
+		if tt.host {
+			ctx = WithToolsAvailable(ctx, host)
+		}
+		got := resolveTools(ctx, args, &Options{ToolsPrecedence: tt.precedence})
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("agent=%s host=%v precedence=%d: got %q, want %q", tt.agent, tt.host, tt.precedence, got, tt.want)
+		}
+	}
+}
+
+func TestBuildPayloadEnriches(t *testing.T) {
+	opts := &Options{Enrich: func(_ context.Context, f *Feedback) error {
+		f.UserGoal = "ship the quarterly report"
+		return nil
+	}}
+	if got := BuildPayload(testArgs("enriched"), "test", opts).UserGoal; got != "ship the quarterly report" {
+		t.Fatalf("BuildPayload user_goal = %q, want the enriched value", got)
+	}
+
+	opts.Enrich = func(context.Context, *Feedback) error { return errors.New("lookup failed") }
+	if got := BuildPayload(testArgs("unenriched"), "test", opts).UserGoal; got != "" {
+		t.Fatalf("failed Enrich changed user_goal to %q", got)
+	}
+}
+
+func TestURLProviderCachedPerOptions(t *testing.T) {
+	primary, primaryAuths := recordingSidecar(t)
+	shadow, shadowAuths := recordingSidecar(t)
+	var calls atomic.Int32
+	release := make(chan struct{})
+	opts := &Options{
+		ShadowURL: shadow.URL,
+		URLProvider: func(context.Context) (string, error) {
+			calls.Add(1)
+			<-release
+			return primary.URL + "/upload?sig=secret", nil
+		},
+	}
+
+	var wg sync.WaitGroup
+	for i := range 3 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if res := SubmitFeedback(context.Background(), testArgs(fmt.Sprintf("provided %d", i)), "test", opts); !res.Delivered {
+				t.Errorf("submission %d not delivered: %q", i, res.Message)
+			}
+		}()
+	}
+	time.Sleep(20 * time.Millisecond) // let all three wait on the provider
+	close(release)
+	wg.Wait()
+	if err := Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("URLProvider called %d times, want 1", n)
+	}
+	if n := len(primaryAuths()); n != 3 {
+		t.Fatalf("provided URL got %d requests, want 3", n)
+	}
+	if n := len(shadowAuths()); n != 3 {
+		t.Fatalf("shadow got %d requests, want 3", n)
+	}
+}
+
+func TestETagPreconditionFailedIsDelivered(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.Header().Set("ETag", `"v1"`)
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer srv.Close()
+	opts := &Options{SidecarURL: srv.URL, UseETag: true}
+
+	for _, attempt := range []string{"first", "repeat"} {
+		if res := SubmitFeedback(context.Background(), testArgs("etag"), "test", opts); !res.Delivered {
+			t.Fatalf("%s submission not delivered: %q", attempt, res.Message)
+		}
+	}
+}
+
+func TestShadowIgnoresEnvRouting(t *testing.T) {
+	primary, primaryAuths := recordingSidecar(t)
+	shadow, shadowAuths := recordingSidecar(t)
+	defer func(name string) { envName = name }(envName)
+	envName = "prod"
+	opts := &Options{EnvRouting: map[string]string{"prod": primary.URL}, ShadowURL: shadow.URL}
+
+	if res := SubmitFeedback(context.Background(), testArgs("routed"), "test", opts); !res.Delivered {
+		t.Fatalf("not delivered: %q", res.Message)
+	}
+	if err := Close(context.Background()); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+	if p, s := len(primaryAuths()), len(shadowAuths()); p != 1 || s != 1 {
+		t.Fatalf("primary got %d requests, shadow %d; want 1 each", p, s)
+	}
+}
+
+func TestBatchQueuePriority(t *testing.T) {
+	q := &batchQueue{opts: &Options{BatchSize: 100, QueueCapacity: 3}, space: make(chan struct{})}
+	add := func(name, priority string) bool {
+		return q.add(context.Background(), queuedFeedback{body: []byte(name), priority: priority})
+	}
+	for _, it := range [][2]string{{"low-1", "low"}, {"normal-1", "normal"}, {"low-2", "low"}} {
+		add(it[0], it[1])
+	}
+	if !add("high-1", "high") {
+		t.Fatal("high priority refused from a queue holding low priority items")
+	}
+	if !add("normal-2", "normal") {
+		t.Fatal("normal priority refused from a queue holding a low priority item")
+	}
+	if add("low-3", "low") {
+		t.Fatal("low priority queued ahead of higher priority items")
+	}
+
+	var got []string
+	for _, it := range q.take() {
+		got = append(got, string(it.body))
+	}
+	if want := []string{"high-1", "normal-1", "normal-2"}; !slices.Equal(got, want) {
+		t.Fatalf("flush order = %q, want %q", got, want)
+	}
+}
+
+func TestBatchQueuePriorityConcurrent(t *testing.T) {
+	const capacity = 10
+	q := &batchQueue{opts: &Options{BatchSize: 1000, QueueCapacity: capacity}, space: make(chan struct{}), full: make(chan struct{}, 1)}
+	counts := map[string]int{"high": capacity, "normal": 30, "low": 30}
+
+	var flushed [][]queuedFeedback
+	captureStderr(t, func() { // keep full-queue drop warnings out of the test log
+		var adds sync.WaitGroup
+		for priority, n := range counts {
+			for i := range n {
+				adds.Add(1)
+				go func() {
+					defer adds.Done()
+					q.add(context.Background(), queuedFeedback{body: []byte(fmt.Sprintf("%s-%d", priority, i)), priority: priority})
+				}()
+			}
+		}
+		done := make(chan struct{})
+		go func() {
+			adds.Wait()
+			close(done)
+		}()
+		for {
+			select {
+			case <-done:
+				flushed = append(flushed, q.take())
+				return
+			default:
+				flushed = append(flushed, q.take())
+				runtime.Gosched()
+			}
+		}
+	})
+
+	seen := map[string]bool{}
+	high := 0
+	for _, batch := range flushed {
+		if len(batch) > capacity {
+			t.Fatalf("flushed %d items from a queue of capacity %d", len(batch), capacity)
+		}
+		if !slices.IsSortedFunc(batch, func(a, b queuedFeedback) int { return b.rank() - a.rank() }) {
+			t.Fatalf("batch not in priority order: %v", batch)
+		}
+		for _, it := range batch {
+			if seen[string(it.body)] {
+				t.Fatalf("%s flushed twice", it.body)
+			}
+			seen[string(it.body)] = true
+			if it.priority == "high" {
+				high++
+			}
+		}
+	}
+	// There are never more high items than room, so none may be evicted.
+	if high != counts["high"] {
+		t.Fatalf("flushed %d high priority items, want all %d", high, counts["high"])
+	}
+}
+
+func TestResultEndpointIsProvidedURL(t *testing.T) {
+	srv, _ := recordingSidecar(t)
+	opts := &Options{URLProvider: func(context.Context) (string, error) {
+		return srv.URL + "/upload?sig=secret", nil
+	}}
+	res := SubmitFeedback(context.Background(), testArgs("presigned"), "test", opts)
+	if !res.Delivered {
+		t.Fatalf("not delivered: %q", res.Message)
+	}
+	if want := srv.URL + "/upload"; res.Endpoint != want || res.Path != PathProvided {
+		t.Fatalf("Endpoint, Path = %q, %q; want %q, %q", res.Endpoint, res.Path, want, PathProvided)
+	}
+}
+
+// reportingTransport fails every delivery and, like a host wired to report
+// its own errors, files a missing-tool report from inside Deliver.
+type reportingTransport struct {
+	calls int
+	inner []Result
+}
+
+func (t *reportingTransport) Deliver(ctx context.Context, body []byte) error {
+	t.calls++
+	if t.calls < 10 {
+		t.inner = append(t.inner, ReportMissingTool(ctx, "retry_upload", "test", &Options{Transport: t}))
+	}
+	return &DeliveryError{Err: errors.New("sidecar down")}
+}
+
+func TestReentrantFeedbackRefused(t *testing.T) {
+	tr := &reportingTransport{}
+	res := SubmitFeedback(context.Background(), testArgs("outer"), "test", &Options{Transport: tr})
+	if res.Delivered {
+		t.Fatalf("outer submission delivered through a failing transport")
+	}
+	if tr.calls != 1 || len(tr.inner) != 1 {
+		t.Fatalf("transport called %d times with %d nested reports, want 1 and 1", tr.calls, len(tr.inner))
+	}
+	if !errors.Is(tr.inner[0].Err, ErrReentrant) {
+		t.Fatalf("nested report Err = %v, want ErrReentrant", tr.inner[0].Err)
+	}
+	if InFeedback(context.Background()) {
+		t.Fatal("InFeedback true for a fresh context")
+	}
+}
+
+// panickingTransport records each payload and panics on call number panicAt,
+// standing in for a process killed partway through a replay.
+type panickingTransport struct {
+	panicAt  int
+	payloads []string
+}
+
+func (t *panickingTransport) Deliver(ctx context.Context, body []byte) error {
+	if len(t.payloads)+1 == t.panicAt {
+		panic("killed mid-replay")
+	}
+	t.payloads = append(t.payloads, string(body))
+	return nil
+}
+
+func TestInterruptedReplayLosesNothing(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spool.jsonl")
+	want := []string{`{"n":1}`, `{"n":2}`, `{"n":3}`}
+	for _, p := range want {
+		if err := appendSpool(path, SpoolEntry{Payload: json.RawMessage(p), SpooledAt: time.Now()}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	crashing := &panickingTransport{panicAt: 2}
+	func() {
+		defer func() { recover() }()
+		ReplaySpool(context.Background(), &Options{SpoolPath: path, Transport: crashing})
+	}()
+	if err := appendSpool(path, SpoolEntry{Payload: json.RawMessage(`{"n":4}`), SpooledAt: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+	want = append(want, `{"n":4}`)
+
+	recovered := &panickingTransport{}
+	if _, err := ReplaySpool(context.Background(), &Options{SpoolPath: path, Transport: recovered}); err != nil {
+		t.Fatalf("ReplaySpool after interruption: %v", err)
+	}
+	got := append(crashing.payloads, recovered.payloads...)
+	for _, p := range want {
+		if !slices.Contains(got, p) {
+			t.Errorf("payload %s lost; delivered %q", p, got)
+		}
+	}
+	for _, f := range []string{path, replayPath(path)} {
+		if _, err := os.Stat(f); !errors.Is(err, os.ErrNotExist) {
+			t.Errorf("%s left behind after a full replay", filepath.Base(f))
+		}
+	}
+}
+
+func TestHealthProbeIgnoredWithTransport(t *testing.T) {
+	defer Close(context.Background())
+	tr := &scriptedTransport{}
+	opts := &Options{
+		Transport:           tr,
+		SidecarURL:          "http://127.0.0.1:1", // nothing listens; the probe fails
+		HealthProbeInterval: 5 * time.Millisecond,
+	}
+	for i := range 3 {
+		if res := SubmitFeedback(context.Background(), testArgs(fmt.Sprintf("probed %d", i)), "test", opts); !res.Delivered {
+			t.Fatalf("submission %d not delivered: %q", i, res.Message)
+		}
+		time.Sleep(20 * time.Millisecond) // let a failed probe land
+	}
+	if got := tr.count(); got != 3 {
+		t.Fatalf("transport got %d submissions, want 3", got)
+	}
+}
+
+func TestUnsentLineRoundTrip(t *testing.T) {
+	line := UnsentLine{
+		Time:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+		Reason:  "status_503",
+		Payload: json.RawMessage(`{"what_i_needed":"a <b> & c"}`),
+	}
+	formatted := FormatUnsentLine(line)
+	if !strings.HasPrefix(formatted, logPrefix+" {") || strings.Contains(formatted, "\n") {
+		t.Fatalf("not a single prefixed JSON line: %q", formatted)
+	}
+	for _, input := range []string{formatted, "2026-01-02T03:04:05Z stderr F " + formatted} {
+		got, err := ParseUnsentLine(input)
+		if err != nil {
+			t.Fatalf("ParseUnsentLine(%q): %v", input, err)
+		}
+		if !got.Time.Equal(line.Time) || got.Reason != line.Reason || string(got.Payload) != string(line.Payload) {
+			t.Fatalf("round trip = %+v, want %+v", got, line)
+		}
+	}
+}
+
+func TestParseUnsentLine(t *testing.T) {
+	tests := []struct {
+		line    string
+		reason  string
+		payload string
+		wantErr bool
+	}{
+		{logPrefix + ` reason=unreachable:boom payload={"a":1}`, "unreachable:boom", `{"a":1}`, false},
+		{logPrefix + ` {"reason":"status_500","payload":{"a":1}}`, "status_500", `{"a":1}`, false},
+		{`some other log line`, "", "", true},
+		{logPrefix + ` reason=status_500 payload={not json`, "", "", true},
+		{logPrefix + ` something else`, "", "", true},
+	}
+	for _, tt := range tests {
+		got, err := ParseUnsentLine(tt.line)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseUnsentLine(%q) error = %v, wantErr %v", tt.line, err, tt.wantErr)
+			continue
+		}
+		if err == nil && (got.Reason != tt.reason || string(got.Payload) != tt.payload) {
+			t.Errorf("ParseUnsentLine(%q) = %q, %s; want %q, %s", tt.line, got.Reason, got.Payload, tt.reason, tt.payload)
+		}
+	}
+}
+
+func TestSyncSLALeavesBatchedRetries(t *testing.T) {
+	tr := &scriptedTransport{fail: 1}
+	opts := &Options{Transport: tr, Clock: &fakeClock{}, BatchSize: 2, SyncSLA: time.Millisecond}
+	if res := SubmitFeedback(context.Background(), testArgs("batched"), "test", opts); res.Delivered {
+		t.Fatalf("batched submission sent synchronously: %q", res.Message)
+	}
+	if err := Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.count(); got != 2 {
+		t.Fatalf("transport calls = %d, want 2 (SyncSLA disabled the batched retry)", got)
+	}
+}
+
+// capturingTransport accepts every delivery and keeps the last body.
+type capturingTransport struct {
+	body []byte
+}
+
+func (t *capturingTransport) Deliver(ctx context.Context, body []byte) error {
+	t.body = body
+	return nil
+}
+
+func TestPayloadLimitDropsLists(t *testing.T) {
+	args := testArgs("oversized")
+	refs := make([]any, 8)
+	for i := range refs {
+		refs[i] = fmt.Sprintf("https://example.com/trace/%d/%s", i, strings.Repeat("x", 100))
+	}
+	args["references"] = refs
+
+	tr := &capturingTransport{}
+	opts := &Options{
+		Transport:            tr,
+		MaxPayloadBytes:      700,
+		PayloadLimitStrategy: PayloadDropLargest,
+	}
+	if res := SubmitFeedback(context.Background(), args, "test", opts); !res.Delivered {
+		t.Fatalf("not delivered: %q", res.Message)
+	}
+	var sent Feedback
+	if err := json.Unmarshal(tr.body, &sent); err != nil {
+		t.Fatal(err)
+	}
+	if sent.References != nil || !slices.Contains(sent.ClientWarnings, "references: dropped to fit MaxPayloadBytes") {
+		t.Fatalf("references kept: %v, warnings %q", sent.References, sent.ClientWarnings)
+	}
+
+	opts.PayloadLimitStrategy = PayloadReject
+	res := SubmitFeedback(context.Background(), args, "test", opts)
+	if !res.Rejected || !strings.Contains(res.Message, "shorten references, ") {
+		t.Fatalf("rejection = %+v, want it to name references first", res)
+	}
+}
+
+func TestJitterBounds(t *testing.T) {
+	const ib = initialBackoff
+	tests := []struct {
+		strategy JitterStrategy
+		low      []time.Duration // Rand always returns 0
+		high     []time.Duration // Rand always returns n-1
+	}{
+		{JitterFull, []time.Duration{0, 0}, []time.Duration{ib - 1, 2*ib - 1}},
+		{JitterEqual, []time.Duration{ib / 2, ib}, []time.Duration{ib - 1, 2*ib - 1}},
+		{JitterDecorrelated, []time.Duration{ib, ib}, []time.Duration{3*ib - 1, 9*ib - 4}},
+	}
+	for _, tt := range tests {
+		for _, edge := range []struct {
+			rand func(n int64) int64
+			want []time.Duration
+		}{
+			{func(int64) int64 { return 0 }, tt.low},
+			{func(n int64) int64 { return n - 1 }, tt.high},
+		} {
+			clock := &fakeClock{}
+			opts := &Options{
+				Transport:      &scriptedTransport{fail: 2},
+				Clock:          clock,
+				Jitter:         true,
+				JitterStrategy: tt.strategy,
+				Rand: func(n int64) int64 {
+					if n <= 0 {
+						t.Fatalf("strategy %d: Rand(%d)", tt.strategy, n)
+					}
+					return edge.rand(n)
+				},
+			}
+			if res := SubmitFeedback(context.Background(), testArgs("jitter"), "test", opts); !res.Delivered {
+				t.Fatalf("strategy %d: not delivered: %q", tt.strategy, res.Message)
+			}
+			if got := clock.take(); !slices.Equal(got, edge.want) {
+				t.Errorf("strategy %d: delays = %v, want %v", tt.strategy, got, edge.want)
+			}
+		}
+	}
+}
+
+// gatedTransport blocks every delivery until release is closed.
+type gatedTransport struct {
+	release chan struct{}
+	calls   atomic.Int32
+}
+
+func (t *gatedTransport) Deliver(ctx context.Context, body []byte) error {
+	<-t.release
+	t.calls.Add(1)
+	return nil
+}
+
+func TestBatchQueueSingleFlusher(t *testing.T) {
+	tr := &gatedTransport{release: make(chan struct{})}
+	opts := &Options{Transport: tr, BatchSize: 1, QueueCapacity: 1000}
+	baseline := runtime.NumGoroutine()
+
+	const sends = 100
+	for i := range sends {
+		SubmitFeedback(context.Background(), testArgs(fmt.Sprintf("batched %d", i)), "test", opts)
+	}
+	if n := runtime.NumGoroutine() - baseline; n > 2 {
+		t.Fatalf("%d goroutines for %d full batches, want one flusher", n, sends)
+	}
+	close(tr.release)
+	if err := Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if got := tr.calls.Load(); got != sends {
+		t.Fatalf("delivered %d, want %d", got, sends)
+	}
+	batchMu.Lock()
+	defer batchMu.Unlock()
+	if len(queues) != 0 {
+		t.Fatalf("%d queues left after Close", len(queues))
+	}
+}
+
+// stoppedClock is a fakeClock whose Now never moves.
+type stoppedClock struct {
+	fakeClock
+	now time.Time
+}
+
+func (c *stoppedClock) Now() time.Time { return c.now }
+
+func TestUnsentLineHMAC(t *testing.T) {
+	key := SigningKey{ID: "k1", Secret: []byte("secret")}
+	var got []UnsentLine
+	opts := &Options{
+		Clock:            &stoppedClock{now: time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)},
+		SignUnsentLog:    &key,
+		SilenceUnsentLog: true,
+		OnUnsent:         func(l UnsentLine) { got = append(got, l) },
+	}
+
+	// HMAC-SHA256("secret", "2026-01-02T03:04:05Z\nstatus_503\n{\"a\":1}"),
+	// computed independently of this package.
+	logUnsentPayload([]byte(`{"a":1}`), "status_503", opts)
+	if want := "596b828fa1d62d0f16c9db76ecd1093a9a9305792f16d2df9414bb12f51df586"; got[0].HMAC != want || got[0].KeyID != "k1" {
+		t.Fatalf("key_id, hmac = %q, %q; want k1, %q", got[0].KeyID, got[0].HMAC, want)
+	}
+
+	// Whatever the body, the signature covers the payload bytes as logged.
+	logUnsentPayload([]byte("{ \"a\": 1 }"), "status_503", opts)
+	logUnsentPayload([]byte{0xa1, 0x61, 'a', 0x01}, "status_415", opts) // CBOR
+	for _, l := range got {
+		parsed, err := ParseUnsentLine(FormatUnsentLine(l))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !VerifyUnsentLine(parsed, key) {
+			t.Errorf("logged line %s does not verify", FormatUnsentLine(l))
+		}
+		parsed.Reason += "x"
+		if VerifyUnsentLine(parsed, key) {
+			t.Errorf("altered line %s verifies", FormatUnsentLine(l))
+		}
+	}
+	if VerifyUnsentLine(got[0], SigningKey{ID: "k1", Secret: []byte("other")}) {
+		t.Error("line verifies with the wrong secret")
+	}
+}
+
+func TestChunkedUnsentLineReassembles(t *testing.T) {
+	lines := make([]UnsentLine, 2)
+	chunks := make([][]string, 2)
+	for i := range lines {
+		lines[i] = UnsentLine{
+			Time:    time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC),
+			Reason:  fmt.Sprintf("status_50%d", i),
+			Payload: json.RawMessage(fmt.Sprintf(`{"what_i_needed":%q}`, strings.Repeat(fmt.Sprint(i), 600))),
+		}
+		chunks[i] = chunkUnsentLine(FormatUnsentLine(lines[i]), 256)
+		if len(chunks[i]) < 3 {
+			t.Fatalf("line %d split into %d chunks, want several", i, len(chunks[i]))
+		}
+		for _, c := range chunks[i] {
+			if len(c) > 256 {
+				t.Fatalf("chunk of %d bytes over the 256-byte limit", len(c))
+			}
+		}
+	}
+	if got := chunkUnsentLine("short", 256); !slices.Equal(got, []string{"short"}) {
+		t.Fatalf("short line chunked: %q", got)
+	}
+
+	// Interleave the two lines' chunks, the second in reverse, with
+	// unrelated log lines between them.
+	var stream []string
+	for i := range max(len(chunks[0]), len(chunks[1])) {
+		if i < len(chunks[0]) {
+			stream = append(stream, chunks[0][i])
+		}
+		if j := len(chunks[1]) - 1 - i; j >= 0 {
+			stream = append(stream, "2026-01-02T03:04:05Z "+chunks[1][j])
+		}
+		stream = append(stream, "unrelated log line")
+	}
+
+	var r UnsentReassembler
+	var got []UnsentLine
+	for _, s := range stream {
+		l, ok, err := r.Add(s)
+		if err != nil {
+			t.Fatalf("Add(%q): %v", s, err)
+		}
+		if ok {
+			got = append(got, l)
+		}
+	}
+	if len(got) != 2 {
+		t.Fatalf("reassembled %d lines, want 2", len(got))
+	}
+	for _, l := range got {
+		want := lines[0]
+		if l.Reason == lines[1].Reason {
+			want = lines[1]
+		}
+		if !l.Time.Equal(want.Time) || l.Reason != want.Reason || string(l.Payload) != string(want.Payload) {
+			t.Errorf("reassembled %+v, want %+v", l, want)
+		}
+	}
+	if _, _, err := r.Add(chunkPrefix + ` {"id":"x","seq":3,"total":2,"data":"AA=="}`); err == nil {
+		t.Error("out of range chunk accepted")
+	}
+}
+
+func TestValidateArgs(t *testing.T) {
+	with := func(key string, value any) map[string]any {
+		args := testArgs("a report")
+		if value == nil {
+			delete(args, key)
+		} else {
+			args[key] = value
+		}
+		return args
+	}
+	tests := []struct {
+		name string
+		args map[string]any
+		want []string
+	}{
+		{"valid", testArgs("a report"), nil},
+		{"gap_type array", with("gap_type", []any{"missing_tool", "wrong_format"}), nil},
+		{"gap_type comma list", with("gap_type", "missing_tool, wrong_format"), nil},
+		{"gap_type missing", with("gap_type", nil), []string{"gap_type: required"}},
+		{"gap_type empty array", with("gap_type", []any{}), []string{"gap_type: required"}},
+		{"what_i_needed number", with("what_i_needed", 42.0), []string{"what_i_needed: coerced float64 to string"}},
+		{"what_i_tried bool", with("what_i_tried", true), []string{"what_i_tried: coerced bool to string"}},
+		{"what_i_needed blank", with("what_i_needed", "  "), []string{"what_i_needed: required"}},
+		{"what_i_needed object", with("what_i_needed", map[string]any{}), []string{
+			"what_i_needed: required", "what_i_needed: dropped non-scalar map[string]interface {} value",
+		}},
+	}
+	for _, tt := range tests {
+		if got := ValidateArgs(tt.args, nil); !slices.Equal(got, tt.want) {
+			t.Errorf("%s: ValidateArgs = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// recordingLogger keeps the message of every Debug call.
+type recordingLogger struct {
+	mu   sync.Mutex
+	msgs []string
+}
+
+func (l *recordingLogger) Debug(msg string, args ...any) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.msgs = append(l.msgs, fmt.Sprint(append([]any{msg}, args...)...))
+}
+
+// captureStderr returns everything written to os.Stderr while fn runs.
+func captureStderr(t *testing.T, fn func()) string {
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := os.Stderr
+	os.Stderr = w
+	defer func() { os.Stderr = saved }()
+	done := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		done <- string(b)
+	}()
+	fn()
+	w.Close()
+	return <-done
+}
+
+func TestShadowWarningsStayOffStderr(t *testing.T) {
+	primary, _ := recordingSidecar(t)
+	// The shadow refuses the configured encoding and advertises a schema
+	// version we don't speak, each of which warns on the primary path.
+	shadow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(schemaSupportedHeader, "0")
+		if r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusUnsupportedMediaType)
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+	}))
+	defer shadow.Close()
+	logger := &recordingLogger{}
+	opts := &Options{
+		SidecarURL: primary.URL,
+		ShadowURL:  shadow.URL,
+		Encoding:   &Encoding{ContentType: "application/x-shadow-test", Marshal: json.Marshal},
+		Logger:     logger,
+	}
+
+	for _, debug := range []bool{false, true} {
+		opts.DebugLog = debug
+		refusedEncodings.Delete(shadow.URL + " application/x-shadow-test")
+		schemaWarned.Range(func(k, _ any) bool { schemaWarned.Delete(k); return true })
+		stderr := captureStderr(t, func() {
+			SubmitFeedback(context.Background(), testArgs("mirrored"), "test", opts)
+			if err := Close(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+		})
+		if strings.Contains(stderr, warnPrefix) {
+			t.Fatalf("DebugLog=%v: shadow send warned on stderr:\n%s", debug, stderr)
+		}
+	}
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+	var warnings int
+	for _, m := range logger.msgs {
+		if strings.HasPrefix(m, "shadow send warning") {
+			warnings++
+		}
+	}
+	if warnings != 2 {
+		t.Fatalf("debug log got %d shadow warnings, want 2 (encoding and schema): %q", warnings, logger.msgs)
+	}
+}
@@ -0,0 +1,160 @@
+// PatchworkMCP — SQLite sink for offline-first Go MCP servers.
+//
+// Copy this directory next to the feedback package. It records each
+// submission in a local SQLite table instead of posting it, and Replay
+// forwards pending rows to the sidecar once connectivity returns. It lives
+// in its own package so the core drop-in stays dependency-free; bring any
+// database/sql SQLite driver, e.g.:
+//
+//   go get modernc.org/sqlite
+//
+//	db, _ := sql.Open("sqlite", "feedback.db")
+//	sink, err := sqlitesink.New(db)
+//	feedback.RegisterFeedbackTool(s, "my-server", &feedback.Options{Transport: sink})
+//
+//	// When the network is back:
+//	sink.Replay(ctx, feedback.HTTPTransport(nil))
+
+package sqlitesink
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// Row status values.
+const (
+	StatusPending = "pending"
+	StatusSent    = "sent"
+)
+
+// migrations are applied in order, one statement each; PRAGMA user_version
+// records how many have run. Append new ones, never edit old ones.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS feedback_outbox (
+		id          INTEGER PRIMARY KEY AUTOINCREMENT,
+		payload     TEXT NOT NULL,
+		status      TEXT NOT NULL DEFAULT 'pending',
+		created_at  TEXT NOT NULL,
+		sent_at     TEXT,
+		attempts    INTEGER NOT NULL DEFAULT 0,
+		last_error  TEXT
+	)`,
+	`ALTER TABLE feedback_outbox ADD COLUMN server_name TEXT NOT NULL DEFAULT ''`,
+	`ALTER TABLE feedback_outbox ADD COLUMN gap_type TEXT NOT NULL DEFAULT ''`,
+	`CREATE INDEX IF NOT EXISTS idx_feedback_outbox_status ON feedback_outbox(status, id)`,
+}
+
+// Sink stores feedback in SQLite. It implements the feedback package's
+// Transport interface, so set it as Options.Transport.
+type Sink struct {
+	db *sql.DB
+}
+
+// New returns a Sink on db, creating or upgrading its table.
+func New(db *sql.DB) (*Sink, error) {
+	if err := migrate(db); err != nil {
+		return nil, fmt.Errorf("sqlitesink: migrating: %w", err)
+	}
+	return &Sink{db: db}, nil
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return err
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		// PRAGMA doesn't take bind parameters.
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Deliver records body as a pending row. It never contacts the sidecar.
+func (s *Sink) Deliver(ctx context.Context, body []byte) error {
+	var p struct {
+		ServerName string `json:"server_name"`
+		GapType    string `json:"gap_type"`
+	}
+	json.Unmarshal(body, &p) // best effort; the payload is stored regardless
+	_, err := s.db.ExecContext(ctx,
+		`INSERT INTO feedback_outbox (payload, status, created_at, server_name, gap_type) VALUES (?, ?, ?, ?, ?)`,
+		string(body), StatusPending, time.Now().UTC().Format(time.RFC3339), p.ServerName, p.GapType)
+	return err
+}
+
+// Pending reports how many rows are waiting for Replay.
+func (s *Sink) Pending(ctx context.Context) (int, error) {
+	var n int
+	err := s.db.QueryRowContext(ctx, `SELECT COUNT(*) FROM feedback_outbox WHERE status = ?`, StatusPending).Scan(&n)
+	return n, err
+}
+
+// Deliverer is anything that can send one payload, such as the transport
+// returned by feedback.HTTPTransport.
+type Deliverer interface {
+	Deliver(ctx context.Context, body []byte) error
+}
+
+// Replay sends pending rows to to, oldest first, marking each sent as it
+// succeeds. The first failure is recorded on its row and ends the run,
+// since the sidecar is most likely still unreachable; call Replay again
+// later. Returns the number sent.
+func (s *Sink) Replay(ctx context.Context, to Deliverer) (int, error) {
+	rows, err := s.db.QueryContext(ctx,
+		`SELECT id, payload FROM feedback_outbox WHERE status = ? ORDER BY id`, StatusPending)
+	if err != nil {
+		return 0, err
+	}
+	type pending struct {
+		id      int64
+		payload string
+	}
+	var batch []pending
+	for rows.Next() {
+		var p pending
+		if err := rows.Scan(&p.id, &p.payload); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	sent := 0
+	for _, p := range batch {
+		if err := to.Deliver(ctx, []byte(p.payload)); err != nil {
+			s.db.ExecContext(ctx,
+				`UPDATE feedback_outbox SET attempts = attempts + 1, last_error = ? WHERE id = ?`, err.Error(), p.id)
+			return sent, err
+		}
+		if _, err := s.db.ExecContext(ctx,
+			`UPDATE feedback_outbox SET status = ?, sent_at = ?, attempts = attempts + 1, last_error = NULL WHERE id = ?`,
+			StatusSent, time.Now().UTC().Format(time.RFC3339), p.id); err != nil {
+			return sent, err
+		}
+		sent++
+	}
+	return sent, nil
+}
@@ -25,7 +25,7 @@ from contextlib import asynccontextmanager, contextmanager
 from typing import Optional
 
 import httpx
-from fastapi import FastAPI, HTTPException, Header, Query
+from fastapi import FastAPI, HTTPException, Header, Query, Response
 from fastapi.middleware.cors import CORSMiddleware
 from fastapi.responses import HTMLResponse, StreamingResponse
 from pydantic import BaseModel, Field
@@ -35,6 +35,8 @@ from pydantic import BaseModel, Field
 
 DB_PATH = os.environ.get("FEEDBACK_DB_PATH", "feedback.db")
 API_KEY = os.environ.get("FEEDBACK_API_KEY", "")
+# Payload schema versions accepted, advertised in X-Feedback-Schema-Supported.
+SUPPORTED_SCHEMAS = ["v1"]
 
 
 # ── Database ─────────────────────────────────────────────────────────────────
@@ -621,9 +623,11 @@ def _validate_llm_result(result: dict) -> dict:
 @app.post("/api/feedback", status_code=201)
 async def create_feedback(
     feedback: FeedbackIn,
+    response: Response,
     authorization: Optional[str] = Header(None),
 ):
     check_auth(authorization)
+    response.headers["X-Feedback-Schema-Supported"] = ",".join(SUPPORTED_SCHEMAS)
 
     row_id = str(uuid.uuid4())
     now = datetime.now(timezone.utc).isoformat()
@@ -657,6 +661,19 @@ async def create_feedback(
     return {"id": row_id, "status": "recorded"}
 
 
+@app.post("/api/echo")
+async def echo_feedback(
+    payload: dict,
+    authorization: Optional[str] = Header(None),
+):
+    """Return a submission exactly as received, without storing it.
+
+    Drop-ins in echo mode post here so integrators can see what arrives.
+    """
+    check_auth(authorization)
+    return payload
+
+
 @app.get("/api/feedback")
 async def list_feedback(
     server_name: Optional[str] = Query(None),